@@ -0,0 +1,49 @@
+import { Config } from '@backstage/config';
+import type { TemplateAction } from '@backstage/plugin-scaffolder-backend';
+
+/**
+ * Runs a Pulumi action with the deploy role instead of the Backstage task role.
+ *
+ * The AWS provider of the provisioned stack assumes the role and tags the
+ * session with the component name, so CloudTrail attributes every change to
+ * the Backstage entity that triggered it. Without `pulumi.deployRole.roleArn`
+ * the action is returned unchanged, e.g. for local development.
+ */
+export function withDeployRole(
+  action: TemplateAction<any>,
+  config: Config,
+): TemplateAction<any> {
+  const roleArn = config.getOptionalString('pulumi.deployRole.roleArn');
+  if (!roleArn) {
+    return action;
+  }
+  const sessionTag =
+    config.getOptionalString('pulumi.deployRole.sessionTag') ??
+    'backstage-entity';
+
+  return {
+    ...action,
+    async handler(ctx) {
+      const entity = String(ctx.input.name);
+      const assumeRole = {
+        roleArn,
+        // session names only allow [\w+=,.@-] and 64 characters
+        sessionName: `backstage-${entity}`
+          .replace(/[^\w+=,.@-]/g, '-')
+          .slice(0, 64),
+        tags: { [sessionTag]: entity },
+      };
+
+      await action.handler({
+        ...ctx,
+        input: {
+          ...ctx.input,
+          config: {
+            ...(ctx.input.config ?? {}),
+            'aws:assumeRole': JSON.stringify(assumeRole),
+          },
+        },
+      });
+    },
+  };
+}
@@ -9,6 +9,7 @@ import {
 } from '@pulumi/backstage-scaffolder-backend-pulumi';
 
 import { ScmIntegrations } from '@backstage/integration';
+import { withDeployRole } from './deployRole';
 
 export default async function createPlugin(
   env: PluginEnvironment,
@@ -21,7 +22,7 @@ export default async function createPlugin(
 
   const actions = [
     pulumiNewAction(),
-    pulumiUpAction(),
+    withDeployRole(pulumiUpAction(), env.config),
     ...createBuiltinActions({
       integrations,
       catalogClient,
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// subnetTiers are allocated in this order, one subnet per availability zone each.
+var subnetTiers = []string{"public", "app", "db"}
+
+// legacyPublicCidrs are the public subnets stacks were created with before the
+// tiers were allocated. They stay in place wherever the VPC still has room for them.
+var legacyPublicCidrs = []string{"10.0.0.64/27", "10.0.0.128/27"}
+
+// subnetConfig is read from the `subnets` config key.
+type subnetConfig struct {
+	// PrefixLengths are the subnet sizes per tier, like 28 for a /28.
+	PrefixLengths map[string]int `json:"prefixLengths"`
+	// Cidrs pin the subnets of a tier, one per availability zone, instead of
+	// allocating them. Without it, only the legacyPublicCidrs are kept.
+	Cidrs map[string][]string `json:"cidrs"`
+}
+
+func (c subnetConfig) withDefaults() subnetConfig {
+	prefixLengths := map[string]int{
+		// load balancers need at least a /27
+		"public": 27,
+		"app":    28,
+		"db":     28,
+	}
+	for tier, prefixLength := range c.PrefixLengths {
+		prefixLengths[tier] = prefixLength
+	}
+	c.PrefixLengths = prefixLengths
+	return c
+}
+
+// cidrAllocator carves IPv4 subnets out of a VPC CIDR around the blocks already in use.
+type cidrAllocator struct {
+	vpc  *net.IPNet
+	used []*net.IPNet
+}
+
+// newCIDRAllocator starts with the blocks other programs already use.
+func newCIDRAllocator(vpcCidr string, used []string) (*cidrAllocator, error) {
+	_, vpc, err := net.ParseCIDR(vpcCidr)
+	if err != nil {
+		return nil, err
+	}
+	if vpc.IP.To4() == nil {
+		return nil, fmt.Errorf("VPC CIDR %s is not IPv4", vpcCidr)
+	}
+
+	allocator := &cidrAllocator{vpc: vpc}
+	for _, cidr := range used {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		allocator.used = append(allocator.used, block)
+	}
+	return allocator, nil
+}
+
+// reserve marks a block as used. It fails when the block lies outside the VPC
+// or overlaps a block in use.
+func (a *cidrAllocator) reserve(cidr string) error {
+	_, block, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	vpcOnes, _ := a.vpc.Mask.Size()
+	ones, _ := block.Mask.Size()
+	if ones < vpcOnes || !a.vpc.Contains(block.IP) {
+		return fmt.Errorf("subnet %s is outside of VPC %s", cidr, a.vpc)
+	}
+	if used := a.overlapping(block); used != nil {
+		return fmt.Errorf("subnet %s overlaps %s", cidr, used)
+	}
+	a.used = append(a.used, block)
+	return nil
+}
+
+// fits reports whether every block lies inside the VPC and is free.
+func (a *cidrAllocator) fits(cidrs []string) bool {
+	vpcOnes, _ := a.vpc.Mask.Size()
+	for _, cidr := range cidrs {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false
+		}
+		ones, _ := block.Mask.Size()
+		if ones < vpcOnes || !a.vpc.Contains(block.IP) || a.overlapping(block) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// allocate reserves the first free block with the prefix length.
+func (a *cidrAllocator) allocate(prefixLength int) (string, error) {
+	vpcOnes, bits := a.vpc.Mask.Size()
+	if prefixLength < vpcOnes || prefixLength > bits {
+		return "", fmt.Errorf("cannot allocate a /%d in VPC %s", prefixLength, a.vpc)
+	}
+
+	start := binary.BigEndian.Uint32(a.vpc.IP.To4())
+	size := uint32(1) << uint(bits-prefixLength)
+	count := uint32(1) << uint(prefixLength-vpcOnes)
+	for i := uint32(0); i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, start+i*size)
+		block := &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLength, bits)}
+		if a.overlapping(block) == nil {
+			a.used = append(a.used, block)
+			return block.String(), nil
+		}
+	}
+
+	used := make([]string, 0, len(a.used))
+	for _, block := range a.used {
+		used = append(used, block.String())
+	}
+	return "", fmt.Errorf("VPC %s has no free /%d left, in use: %s", a.vpc, prefixLength, strings.Join(used, ", "))
+}
+
+// overlapping returns the block in use that overlaps the given one, if any.
+func (a *cidrAllocator) overlapping(block *net.IPNet) *net.IPNet {
+	for _, used := range a.used {
+		if used.Contains(block.IP) || block.Contains(used.IP) {
+			return used
+		}
+	}
+	return nil
+}
+
+// allocateSubnets returns the CIDRs of every tier, one per availability zone.
+// Pinned CIDRs are reserved first, so allocated tiers fill the gaps around them.
+func allocateSubnets(cfg subnetConfig, vpcCidr string, used []string, zones int) (map[string][]string, error) {
+	allocator, err := newCIDRAllocator(vpcCidr, used)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := cfg.Cidrs
+	if pinned == nil {
+		pinned = map[string][]string{}
+		if len(legacyPublicCidrs) == zones && allocator.fits(legacyPublicCidrs) {
+			pinned["public"] = legacyPublicCidrs
+		}
+	}
+
+	subnets := map[string][]string{}
+	for _, tier := range subnetTiers {
+		cidrs, ok := pinned[tier]
+		if !ok {
+			continue
+		}
+		if len(cidrs) != zones {
+			return nil, fmt.Errorf("the %s tier needs one subnet per availability zone, got %d subnets for %d zones", tier, len(cidrs), zones)
+		}
+		for _, cidr := range cidrs {
+			if err := allocator.reserve(cidr); err != nil {
+				return nil, fmt.Errorf("%s tier: %w", tier, err)
+			}
+		}
+		subnets[tier] = cidrs
+	}
+
+	for _, tier := range subnetTiers {
+		if _, ok := subnets[tier]; ok {
+			continue
+		}
+		for i := 0; i < zones; i++ {
+			cidr, err := allocator.allocate(cfg.PrefixLengths[tier])
+			if err != nil {
+				return nil, fmt.Errorf("%s tier: %w", tier, err)
+			}
+			subnets[tier] = append(subnets[tier], cidr)
+		}
+	}
+	return subnets, nil
+}
+
+// sharedVpcCidrs reads the VPC CIDR and the subnets in use from the infra stack.
+// The values are needed during the preview, so the outputs must not be secret.
+func sharedVpcCidrs(infraStackRef *pulumi.StackReference, stackName string) (string, []string, error) {
+	vpcCidr, err := infraStackRef.GetOutputDetails("vpc-cidr")
+	if err != nil {
+		return "", nil, err
+	}
+	cidr, ok := vpcCidr.Value.(string)
+	if !ok {
+		return "", nil, fmt.Errorf("stack %s has no vpc-cidr output, update it before allocating subnets", stackName)
+	}
+
+	usedSubnetCidrs, err := infraStackRef.GetOutputDetails("used-subnet-cidrs")
+	if err != nil {
+		return "", nil, err
+	}
+	values, ok := usedSubnetCidrs.Value.([]interface{})
+	if !ok {
+		return "", nil, fmt.Errorf("stack %s has no used-subnet-cidrs output, update it before allocating subnets", stackName)
+	}
+	used := make([]string, 0, len(values))
+	for _, value := range values {
+		subnet, ok := value.(string)
+		if !ok {
+			return "", nil, fmt.Errorf("stack %s has an invalid used-subnet-cidrs output: %v", stackName, values)
+		}
+		used = append(used, subnet)
+	}
+	return cidr, used, nil
+}
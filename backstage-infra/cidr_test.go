@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gitopsSubnets are the public subnets and the Fargate subnets of gitops-infra.
+var gitopsSubnets = []string{
+	"10.0.0.0/27",
+	"10.0.0.32/27",
+	"10.0.0.192/27",
+	"10.0.0.224/27",
+}
+
+func TestAllocateSubnetsKeepsLegacyPublicSubnets(t *testing.T) {
+	// the public subnets must not move when the infra stack adds or drops subnets around them
+	for _, used := range [][]string{gitopsSubnets, gitopsSubnets[:2], append([]string{"10.0.0.240/28"}, gitopsSubnets[:3]...)} {
+		subnets, err := allocateSubnets(subnetConfig{}.withDefaults(), "10.0.0.0/24", used, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(legacyPublicCidrs, subnets["public"]) {
+			t.Errorf("public subnets with %v in use = %v, want %v", used, subnets["public"], legacyPublicCidrs)
+		}
+	}
+
+	subnets, err := allocateSubnets(subnetConfig{}.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"public": {"10.0.0.64/27", "10.0.0.128/27"},
+		"app":    {"10.0.0.96/28", "10.0.0.112/28"},
+		"db":     {"10.0.0.160/28", "10.0.0.176/28"},
+	}
+	if !reflect.DeepEqual(expected, subnets) {
+		t.Errorf("allocated subnets = %v, want %v", subnets, expected)
+	}
+}
+
+func TestAllocateSubnetsOutsideTheLegacyVpc(t *testing.T) {
+	subnets, err := allocateSubnets(subnetConfig{}.withDefaults(), "172.16.0.0/24", []string{"172.16.0.0/26"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"public": {"172.16.0.64/27", "172.16.0.96/27"},
+		"app":    {"172.16.0.128/28", "172.16.0.144/28"},
+		"db":     {"172.16.0.160/28", "172.16.0.176/28"},
+	}
+	if !reflect.DeepEqual(expected, subnets) {
+		t.Errorf("allocated subnets = %v, want %v", subnets, expected)
+	}
+}
+
+func TestAllocateSubnets(t *testing.T) {
+	cfg := subnetConfig{
+		Cidrs: map[string][]string{},
+	}
+	subnets, err := allocateSubnets(cfg.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"public": {"10.0.0.64/27", "10.0.0.96/27"},
+		"app":    {"10.0.0.128/28", "10.0.0.144/28"},
+		"db":     {"10.0.0.160/28", "10.0.0.176/28"},
+	}
+	if !reflect.DeepEqual(expected, subnets) {
+		t.Errorf("allocated subnets = %v, want %v", subnets, expected)
+	}
+}
+
+func TestAllocateSubnetsFillsGapsAroundPinnedTiers(t *testing.T) {
+	cfg := subnetConfig{
+		Cidrs: map[string][]string{
+			"public": {"10.0.0.64/27", "10.0.0.128/27"},
+		},
+	}
+	subnets, err := allocateSubnets(cfg.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"public": {"10.0.0.64/27", "10.0.0.128/27"},
+		"app":    {"10.0.0.96/28", "10.0.0.112/28"},
+		"db":     {"10.0.0.160/28", "10.0.0.176/28"},
+	}
+	if !reflect.DeepEqual(expected, subnets) {
+		t.Errorf("allocated subnets = %v, want %v", subnets, expected)
+	}
+}
+
+func TestAllocateSubnetsFailsWhenVpcIsExhausted(t *testing.T) {
+	cfg := subnetConfig{
+		PrefixLengths: map[string]int{"db": 27},
+		Cidrs:         map[string][]string{},
+	}
+	_, err := allocateSubnets(cfg.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err == nil || !strings.Contains(err.Error(), "has no free /27 left") {
+		t.Errorf("expected an exhausted VPC, got %v", err)
+	}
+}
+
+func TestAllocateSubnetsRejectsOverlappingPinnedCidrs(t *testing.T) {
+	cfg := subnetConfig{
+		Cidrs: map[string][]string{
+			"app": {"10.0.0.32/28", "10.0.0.48/28"},
+		},
+	}
+	_, err := allocateSubnets(cfg.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err == nil || !strings.Contains(err.Error(), "overlaps 10.0.0.32/27") {
+		t.Errorf("expected an overlap, got %v", err)
+	}
+}
+
+func TestAllocateSubnetsRejectsCidrsOutsideTheVpc(t *testing.T) {
+	cfg := subnetConfig{
+		Cidrs: map[string][]string{
+			"db": {"10.0.1.0/28", "10.0.1.16/28"},
+		},
+	}
+	_, err := allocateSubnets(cfg.withDefaults(), "10.0.0.0/24", gitopsSubnets, 2)
+	if err == nil || !strings.Contains(err.Error(), "outside of VPC") {
+		t.Errorf("expected a subnet outside of the VPC, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	backstageContainerName = "app-first-task"
+	backstagePort          = 7007
+)
+
+// containerDefinition is an ECS container definition, rendered to the JSON the
+// task definition expects.
+type containerDefinition struct {
+	Name             string                `json:"name"`
+	Image            string                `json:"image"`
+	Essential        bool                  `json:"essential"`
+	Environment      []keyValuePair        `json:"environment,omitempty"`
+	Secrets          []containerSecret     `json:"secrets,omitempty"`
+	PortMappings     []portMapping         `json:"portMappings,omitempty"`
+	LogConfiguration *logConfiguration     `json:"logConfiguration,omitempty"`
+	HealthCheck      *healthCheck          `json:"healthCheck,omitempty"`
+	Ulimits          []ulimit              `json:"ulimits,omitempty"`
+	DependsOn        []containerDependency `json:"dependsOn,omitempty"`
+}
+
+// keyValuePair is a plain environment variable.
+type keyValuePair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// containerSecret is an environment variable ECS resolves from Secrets Manager
+// or SSM Parameter Store when starting the task.
+type containerSecret struct {
+	Name      string `json:"name"`
+	ValueFrom string `json:"valueFrom"`
+}
+
+type portMapping struct {
+	ContainerPort int    `json:"containerPort"`
+	HostPort      int    `json:"hostPort,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+type logConfiguration struct {
+	LogDriver string            `json:"logDriver"`
+	Options   map[string]string `json:"options,omitempty"`
+}
+
+// healthCheck is the container health check, intervals are in seconds.
+type healthCheck struct {
+	Command     []string `json:"command"`
+	Interval    int      `json:"interval,omitempty"`
+	Timeout     int      `json:"timeout,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+	StartPeriod int      `json:"startPeriod,omitempty"`
+}
+
+type ulimit struct {
+	Name      string `json:"name"`
+	SoftLimit int    `json:"softLimit"`
+	HardLimit int    `json:"hardLimit"`
+}
+
+// containerDependency delays the start of a container until another one
+// reaches the condition, like START or HEALTHY.
+type containerDependency struct {
+	ContainerName string `json:"containerName"`
+	Condition     string `json:"condition"`
+}
+
+// backstageSettings are the resolved values the Backstage container is configured
+// with. Credentials are passed as Secrets Manager ARNs, never as values.
+type backstageSettings struct {
+	Image                string
+	PostgresHost         string
+	PostgresPort         int
+	PostgresPasswordArn  string
+	BaseURL              string
+	ClusterURL           string
+	TechDocsBucket       string
+	DeployRoleArn        string
+	DeploySessionTag     string
+	ClusterTokenArn      string
+	PulumiAccessTokenArn string
+	LogGroup             string
+	Region               string
+}
+
+// backstageContainerDefinitions renders the container definitions of the Backstage task.
+func backstageContainerDefinitions(settings backstageSettings) (string, error) {
+	definitions := []containerDefinition{
+		{
+			Name:      backstageContainerName,
+			Image:     settings.Image,
+			Essential: true,
+			Environment: []keyValuePair{
+				{Name: "POSTGRES_HOST", Value: settings.PostgresHost},
+				{Name: "POSTGRES_PORT", Value: fmt.Sprint(settings.PostgresPort)},
+				{Name: "POSTGRES_USER", Value: "backstage"},
+				{Name: "BACKSTAGE_BASE_URL", Value: settings.BaseURL},
+				{Name: "WEBSITES_PORT", Value: fmt.Sprint(backstagePort)},
+				{Name: "K8S_CLUSTER_URL", Value: settings.ClusterURL},
+				{Name: "TECHDOCS_BUCKET", Value: settings.TechDocsBucket},
+				{Name: "PULUMI_DEPLOY_ROLE_ARN", Value: settings.DeployRoleArn},
+				{Name: "PULUMI_DEPLOY_SESSION_TAG", Value: settings.DeploySessionTag},
+				{Name: "AWS_REGION", Value: settings.Region},
+			},
+			Secrets: []containerSecret{
+				{Name: "POSTGRES_PASSWORD", ValueFrom: settings.PostgresPasswordArn},
+				{Name: "K8S_CLUSTER_SA_TOKEN", ValueFrom: settings.ClusterTokenArn},
+				{Name: "PULUMI_ACCESS_TOKEN", ValueFrom: settings.PulumiAccessTokenArn},
+			},
+			PortMappings: []portMapping{
+				{ContainerPort: backstagePort, HostPort: backstagePort, Protocol: "tcp"},
+			},
+			LogConfiguration: &logConfiguration{
+				LogDriver: "awslogs",
+				Options: map[string]string{
+					"awslogs-group":         settings.LogGroup,
+					"awslogs-region":        settings.Region,
+					"awslogs-stream-prefix": "backstage",
+				},
+			},
+			HealthCheck: &healthCheck{
+				Command:     []string{"CMD-SHELL", fmt.Sprintf("curl -fs -o /dev/null http://localhost:%d/ || exit 1", backstagePort)},
+				Interval:    30,
+				Timeout:     5,
+				Retries:     3,
+				StartPeriod: 120,
+			},
+			Ulimits: []ulimit{
+				{Name: "nofile", SoftLimit: 65536, HardLimit: 65536},
+			},
+		},
+	}
+
+	rendered, err := json.Marshal(definitions)
+	if err != nil {
+		return "", err
+	}
+	return string(rendered), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testSettings() backstageSettings {
+	return backstageSettings{
+		Image:                "123456789012.dkr.ecr.eu-central-1.amazonaws.com/backstage",
+		PostgresHost:         "backstage.abc.eu-central-1.rds.amazonaws.com",
+		PostgresPort:         5432,
+		PostgresPasswordArn:  "arn:aws:secretsmanager:eu-central-1:123456789012:secret:rds-password",
+		BaseURL:              "http://backstage.example.com",
+		ClusterURL:           "https://cluster.eks.amazonaws.com",
+		TechDocsBucket:       "backstage-techdocs",
+		DeployRoleArn:        "arn:aws:iam::123456789012:role/backstage-deploy",
+		DeploySessionTag:     "backstage-entity",
+		ClusterTokenArn:      "arn:aws:secretsmanager:eu-central-1:123456789012:secret:k8s-cluster-token",
+		PulumiAccessTokenArn: "arn:aws:secretsmanager:eu-central-1:123456789012:secret:pulumi-access-token",
+		LogGroup:             "backstage-log",
+		Region:               "eu-central-1",
+	}
+}
+
+func TestBackstageContainerDefinitions(t *testing.T) {
+	rendered, err := backstageContainerDefinitions(testSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[
+		{
+			"name": "app-first-task",
+			"image": "123456789012.dkr.ecr.eu-central-1.amazonaws.com/backstage",
+			"essential": true,
+			"environment": [
+				{"name": "POSTGRES_HOST", "value": "backstage.abc.eu-central-1.rds.amazonaws.com"},
+				{"name": "POSTGRES_PORT", "value": "5432"},
+				{"name": "POSTGRES_USER", "value": "backstage"},
+				{"name": "BACKSTAGE_BASE_URL", "value": "http://backstage.example.com"},
+				{"name": "WEBSITES_PORT", "value": "7007"},
+				{"name": "K8S_CLUSTER_URL", "value": "https://cluster.eks.amazonaws.com"},
+				{"name": "TECHDOCS_BUCKET", "value": "backstage-techdocs"},
+				{"name": "PULUMI_DEPLOY_ROLE_ARN", "value": "arn:aws:iam::123456789012:role/backstage-deploy"},
+				{"name": "PULUMI_DEPLOY_SESSION_TAG", "value": "backstage-entity"},
+				{"name": "AWS_REGION", "value": "eu-central-1"}
+			],
+			"secrets": [
+				{"name": "POSTGRES_PASSWORD", "valueFrom": "arn:aws:secretsmanager:eu-central-1:123456789012:secret:rds-password"},
+				{"name": "K8S_CLUSTER_SA_TOKEN", "valueFrom": "arn:aws:secretsmanager:eu-central-1:123456789012:secret:k8s-cluster-token"},
+				{"name": "PULUMI_ACCESS_TOKEN", "valueFrom": "arn:aws:secretsmanager:eu-central-1:123456789012:secret:pulumi-access-token"}
+			],
+			"portMappings": [
+				{"containerPort": 7007, "hostPort": 7007, "protocol": "tcp"}
+			],
+			"logConfiguration": {
+				"logDriver": "awslogs",
+				"options": {
+					"awslogs-group": "backstage-log",
+					"awslogs-region": "eu-central-1",
+					"awslogs-stream-prefix": "backstage"
+				}
+			},
+			"healthCheck": {
+				"command": ["CMD-SHELL", "curl -fs -o /dev/null http://localhost:7007/ || exit 1"],
+				"interval": 30,
+				"timeout": 5,
+				"retries": 3,
+				"startPeriod": 120
+			},
+			"ulimits": [
+				{"name": "nofile", "softLimit": 65536, "hardLimit": 65536}
+			]
+		}
+	]`
+
+	assertJSONEqual(t, expected, rendered)
+}
+
+func TestBackstageContainerDefinitionsEscapesValues(t *testing.T) {
+	settings := testSettings()
+	settings.BaseURL = `http://backstage.example.com/"quoted"\path`
+
+	rendered, err := backstageContainerDefinitions(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var definitions []containerDefinition
+	if err := json.Unmarshal([]byte(rendered), &definitions); err != nil {
+		t.Fatalf("rendered definitions are not valid JSON: %v", err)
+	}
+	for _, env := range definitions[0].Environment {
+		if env.Name == "BACKSTAGE_BASE_URL" && env.Value != settings.BaseURL {
+			t.Errorf("BACKSTAGE_BASE_URL = %q, want %q", env.Value, settings.BaseURL)
+		}
+	}
+}
+
+func TestBackstageContainerDefinitionsKeepCredentialsOutOfEnvironment(t *testing.T) {
+	rendered, err := backstageContainerDefinitions(testSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var definitions []containerDefinition
+	if err := json.Unmarshal([]byte(rendered), &definitions); err != nil {
+		t.Fatal(err)
+	}
+	for _, env := range definitions[0].Environment {
+		switch env.Name {
+		case "POSTGRES_PASSWORD", "K8S_CLUSTER_SA_TOKEN", "PULUMI_ACCESS_TOKEN":
+			t.Errorf("%s is a plain environment variable, it must be passed as a secret", env.Name)
+		}
+	}
+}
+
+func assertJSONEqual(t *testing.T, expected, actual string) {
+	t.Helper()
+	var want, got interface{}
+	if err := json.Unmarshal([]byte(expected), &want); err != nil {
+		t.Fatalf("invalid expected JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(actual), &got); err != nil {
+		t.Fatalf("invalid rendered JSON: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("rendered container definitions differ\nwant: %s\ngot:  %s", expected, actual)
+	}
+}
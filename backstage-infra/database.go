@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/rds"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// databaseConfig is read from the `database` config key.
+//
+// Stacks created before the db tier run the instance in the public subnets,
+// and RDS can't move an instance to another subnet group of the same VPC. They
+// set subnetTier to public before upgrading, then migrate with a snapshot:
+//
+//  1. scale the Backstage service to zero and take a manual snapshot
+//  2. set subnetTier to db and snapshotIdentifier to the snapshot
+//  3. run pulumi up, which restores a new instance into the db tier and
+//     deletes the old one with the public subnet group
+//
+// Backstage is down from the snapshot until the service runs against the new
+// instance. snapshotIdentifier has to stay set afterwards, removing it
+// replaces the instance again.
+type databaseConfig struct {
+	// SubnetTier places the instance, either db (default) or public.
+	SubnetTier string `json:"subnetTier"`
+	// SnapshotIdentifier restores the instance from a snapshot.
+	SnapshotIdentifier string `json:"snapshotIdentifier"`
+}
+
+func (c databaseConfig) withDefaults() databaseConfig {
+	if c.SubnetTier == "" {
+		c.SubnetTier = "db"
+	}
+	return c
+}
+
+func (c databaseConfig) validate() error {
+	if c.SubnetTier != "db" && c.SubnetTier != "public" {
+		return fmt.Errorf("unsupported database.subnetTier %q, use db or public", c.SubnetTier)
+	}
+	return nil
+}
+
+// newDatabaseSubnetGroup creates the subnet group of the configured tier. The
+// public one keeps the name of the group stacks were created with, so it stays
+// untouched until the instance is migrated.
+func newDatabaseSubnetGroup(ctx *pulumi.Context, cfg databaseConfig, subnetIDs map[string]pulumi.StringArray) (*rds.SubnetGroup, error) {
+	if cfg.SubnetTier == "public" {
+		return rds.NewSubnetGroup(ctx, "pulumi-backstage-aws-rds-subnet-group", &rds.SubnetGroupArgs{
+			SubnetIds: subnetIDs["public"],
+		})
+	}
+	return rds.NewSubnetGroup(ctx, "pulumi-backstage-aws-rds-db-subnet-group", &rds.SubnetGroupArgs{
+		SubnetIds: subnetIDs["db"],
+	})
+}
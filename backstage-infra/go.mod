@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/pulumi/pulumi-aws/sdk/v6 v6.22.2
 	github.com/pulumi/pulumi-docker/sdk/v4 v4.5.1
+	github.com/pulumi/pulumi-random/sdk/v4 v4.16.0
 	github.com/pulumi/pulumi/sdk/v3 v3.106.0
 )
 
@@ -8,21 +8,17 @@ import (
 
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/alb"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
-	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ecr"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ecs"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/rds"
 	"github.com/pulumi/pulumi-docker/sdk/v4/go/docker"
+	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
 var (
-	publicSubnetCidrs = []string{
-		"10.0.0.64/27",
-		"10.0.0.128/27",
-	}
 	availabilityZones = []string{
 		"eu-central-1a",
 		"eu-central-1b",
@@ -32,79 +28,88 @@ var (
 func main() {
 	pulumi.Run(func(ctx *pulumi.Context) error {
 
-		infraStackRef, err := pulumi.NewStackReference(ctx, config.Get(ctx, "infraStackRef"), nil)
+		infraStackName := config.Get(ctx, "infraStackRef")
+		infraStackRef, err := pulumi.NewStackReference(ctx, infraStackName, nil)
 		if err != nil {
 			return err
 		}
-		vpcId := infraStackRef.GetStringOutput(pulumi.String("vpc-id"))
-
-		group, err := ec2.NewSecurityGroup(ctx, "pulumi-backstage-aws-sg", &ec2.SecurityGroupArgs{
-			VpcId: vpcId,
-			Ingress: ec2.SecurityGroupIngressArray{
-				&ec2.SecurityGroupIngressArgs{
-					Protocol: pulumi.String("tcp"),
-					FromPort: pulumi.Int(80),
-					ToPort:   pulumi.Int(80),
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-				},
-				&ec2.SecurityGroupIngressArgs{
-					Protocol: pulumi.String("tcp"),
-					FromPort: pulumi.Int(5432),
-					ToPort:   pulumi.Int(5432),
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-				},
-			},
-			Egress: ec2.SecurityGroupEgressArray{
-				&ec2.SecurityGroupEgressArgs{
-					Protocol: pulumi.String("-1"),
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-				},
-			},
-		})
-		if err != nil {
+		var existingVpcCfg existingVpcConfig
+		if err := config.GetObject(ctx, "existingVpc", &existingVpcCfg); err != nil {
 			return err
 		}
+		var vpcId pulumi.StringInput
+		var subnetIDs map[string]pulumi.StringArray
+		if existingVpcCfg.enabled() {
+			vpcId, subnetIDs, err = lookupSubnetTiers(ctx, existingVpcCfg)
+			if err != nil {
+				return err
+			}
+		} else {
+			vpcId = infraStackRef.GetStringOutput(pulumi.String("vpc-id"))
 
-		var publicSubnetIDs pulumi.StringArray
+			// carve our subnets out of the space the infra stack left free
+			var subnetCfg subnetConfig
+			if err := config.GetObject(ctx, "subnets", &subnetCfg); err != nil {
+				return err
+			}
+			vpcCidr, usedSubnetCidrs, err := sharedVpcCidrs(infraStackRef, infraStackName)
+			if err != nil {
+				return err
+			}
+			subnetCidrs, err := allocateSubnets(subnetCfg.withDefaults(), vpcCidr, usedSubnetCidrs, len(availabilityZones))
+			if err != nil {
+				return err
+			}
+			// pin these in subnets.cidrs to keep allocated tiers in place
+			ctx.Export("subnet-cidrs", pulumi.ToStringArrayMap(subnetCidrs))
 
-		// Create a subnet for each availability zone
-		for i, az := range availabilityZones {
-			publicSubnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-aws-fargate-subnet-%d", i), &ec2.SubnetArgs{
-				VpcId:                       vpcId,
-				CidrBlock:                   pulumi.String(publicSubnetCidrs[i]),
-				MapPublicIpOnLaunch:         pulumi.Bool(false),
-				AssignIpv6AddressOnCreation: pulumi.Bool(false),
-				AvailabilityZone:            pulumi.String(az),
-				Tags: pulumi.StringMap{
-					"Name": pulumi.Sprintf("pulumi-backstage-aws-subnet-fargate-%s", az),
-				},
-			})
+			privateEgress := config.Get(ctx, "privateEgress")
+			switch privateEgress {
+			case "", egressNat:
+				privateEgress = egressNat
+			case egressEndpoints:
+			default:
+				return fmt.Errorf("unsupported private egress %q, use nat or endpoints", privateEgress)
+			}
+			s3EndpointId, err := sharedS3EndpointID(infraStackRef)
 			if err != nil {
 				return err
 			}
-			_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-aws-rt-association-%s", az), &ec2.RouteTableAssociationArgs{
-				RouteTableId: infraStackRef.GetOutput(pulumi.String("route-table-id")).AsStringOutput(),
-				SubnetId:     publicSubnet.ID(),
-			})
+			if privateEgress == egressEndpoints && s3EndpointId == "" {
+				return fmt.Errorf("the endpoints private egress needs the VPC endpoints of stack %s, enable vpcEndpoints there", infraStackName)
+			}
+
+			routeTableId := infraStackRef.GetOutput(pulumi.String("route-table-id")).AsStringOutput()
+			tiers, err := newSubnetTiers(ctx, subnetCidrs, vpcId, routeTableId, privateEgress)
 			if err != nil {
 				return err
 			}
-			publicSubnetIDs = append(publicSubnetIDs, publicSubnet.ID())
+			subnetIDs = tiers.subnetIDs
+			ctx.Export("private-route-table-ids", tiers.routeTableIds)
+
+			if s3EndpointId != "" {
+				if err := newS3EndpointRoutes(ctx, s3EndpointId, tiers.routeTableIds); err != nil {
+					return err
+				}
+			}
+		}
+		publicSubnetIDs := subnetIDs["public"]
+		appSubnetIDs := subnetIDs["app"]
+
+		var securityGroupCfg securityGroupConfig
+		if err := config.GetObject(ctx, "securityGroups", &securityGroupCfg); err != nil {
+			return err
+		}
+		groups, err := newSecurityGroups(ctx, securityGroupCfg.withDefaults(), vpcId)
+		if err != nil {
+			return err
 		}
 
 		loadBalancer, err := alb.NewLoadBalancer(ctx, "pulumi-backstage-aws-alb", &alb.LoadBalancerArgs{
 			Subnets:          publicSubnetIDs,
 			LoadBalancerType: pulumi.String("application"),
 			SecurityGroups: pulumi.StringArray{
-				group.ID(),
+				groups.alb.ID(),
 			},
 			Name: pulumi.String("pulumi-backstage"),
 		})
@@ -122,43 +127,118 @@ func main() {
 		if err != nil {
 			return err
 		}
+		forward := &alb.ListenerDefaultActionArgs{
+			Type:           pulumi.String("forward"),
+			TargetGroupArn: targetGroup.Arn,
+		}
+		httpAction := forward
+		baseURL := pulumi.Sprintf("http://%s", loadBalancer.DnsName)
+		listeners := []pulumi.Resource{}
+
+		// serve Backstage over HTTPS on a custom domain, plain HTTP only redirects
+		if domain := config.Get(ctx, "domain"); domain != "" {
+			zoneID, err := lookupZoneID(ctx, domain, config.Get(ctx, "dnsZone"))
+			if err != nil {
+				return err
+			}
+
+			certificateArn, err := newValidatedCertificate(ctx, domain, zoneID)
+			if err != nil {
+				return err
+			}
+
+			httpsListener, err := alb.NewListener(ctx, "pulumi-backstage-aws-alb-https-listener", &alb.ListenerArgs{
+				LoadBalancerArn: loadBalancer.Arn,
+				Port:            pulumi.Int(443),
+				Protocol:        pulumi.String("HTTPS"),
+				SslPolicy:       pulumi.String(tlsPolicy),
+				CertificateArn:  certificateArn,
+				DefaultActions: alb.ListenerDefaultActionArray{
+					forward,
+				},
+			})
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, httpsListener)
+
+			err = newAliasRecord(ctx, domain, zoneID, loadBalancer)
+			if err != nil {
+				return err
+			}
+
+			httpAction = &alb.ListenerDefaultActionArgs{
+				Type: pulumi.String("redirect"),
+				Redirect: &alb.ListenerDefaultActionRedirectArgs{
+					Protocol:   pulumi.String("HTTPS"),
+					Port:       pulumi.String("443"),
+					StatusCode: pulumi.String("HTTP_301"),
+				},
+			}
+			baseURL = pulumi.Sprintf("https://%s", domain)
+		}
+
 		allListener, err := alb.NewListener(ctx, "pulumi-backstage-aws-alb-listener", &alb.ListenerArgs{
 			LoadBalancerArn: loadBalancer.Arn,
 			Port:            pulumi.Int(80),
 			Protocol:        pulumi.String("HTTP"),
 			DefaultActions: alb.ListenerDefaultActionArray{
-				&alb.ListenerDefaultActionArgs{
-					Type:           pulumi.String("forward"),
-					TargetGroupArn: targetGroup.Arn,
-				},
+				httpAction,
 			},
 		})
 		if err != nil {
 			return err
 		}
+		listeners = append(listeners, allListener)
+
+		var databaseCfg databaseConfig
+		if err := config.GetObject(ctx, "database", &databaseCfg); err != nil {
+			return err
+		}
+		databaseCfg = databaseCfg.withDefaults()
+		if err := databaseCfg.validate(); err != nil {
+			return err
+		}
+		subnetGroup, err := newDatabaseSubnetGroup(ctx, databaseCfg, subnetIDs)
+		if err != nil {
+			return err
+		}
 
-		subnetGroup, err := rds.NewSubnetGroup(ctx, "pulumi-backstage-aws-rds-subnet-group", &rds.SubnetGroupArgs{
-			SubnetIds: publicSubnetIDs,
+		// generate the master password and keep it in Secrets Manager, ECS injects it into the container
+		dbPassword, err := random.NewRandomPassword(ctx, "pulumi-backstage-aws-rds-password", &random.RandomPasswordArgs{
+			Length:  pulumi.Int(32),
+			Special: pulumi.Bool(true),
+			// RDS doesn't accept /, @, " and spaces in the master password
+			OverrideSpecial: pulumi.String("!#$%&*()-_=+[]{}<>:?"),
 		})
 		if err != nil {
 			return err
 		}
 
-		instance, err := rds.NewInstance(ctx, "pulumi-backstage-aws-rds", &rds.InstanceArgs{
+		dbPasswordSecret, dbPasswordVersion, err := newSecret(ctx, "pulumi-backstage-aws-rds-password", "Master password of the Backstage Postgres instance", dbPassword.Result)
+		if err != nil {
+			return err
+		}
+
+		instanceArgs := &rds.InstanceArgs{
 			AllocatedStorage:   pulumi.Int(5),
 			InstanceClass:      rds.InstanceType_T3_Micro,
 			Engine:             pulumi.String("postgres"),
 			EngineVersion:      pulumi.String("15.4"),
 			Username:           pulumi.String("backstage"),
-			Password:           pulumi.String("backstage"),
+			Password:           dbPassword.Result,
 			PubliclyAccessible: pulumi.Bool(false),
 			DbSubnetGroupName:  subnetGroup.Name,
 			MultiAz:            pulumi.Bool(true),
 			SkipFinalSnapshot:  pulumi.Bool(true),
 			VpcSecurityGroupIds: pulumi.StringArray{
-				group.ID(),
+				groups.database.ID(),
 			},
-		})
+		}
+		if databaseCfg.SnapshotIdentifier != "" {
+			instanceArgs.SnapshotIdentifier = pulumi.String(databaseCfg.SnapshotIdentifier)
+		}
+		instance, err := rds.NewInstance(ctx, "pulumi-backstage-aws-rds", instanceArgs)
 		if err != nil {
 			return err
 		}
@@ -223,44 +303,6 @@ func main() {
 		if err != nil {
 			return err
 		}
-		ecsPolicyResult, _ := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-			Statements: []iam.GetPolicyDocumentStatement{
-				{
-					Effect: pulumi.StringRef("Allow"),
-					Actions: []string{
-						"rds-db:*",
-						"s3:*",
-						"ecr:*",
-						"rds:*",
-						"ecs:*",
-						"ec2:*",
-						"eks:*",
-						"iam:*",
-						"lambda:*",
-						"apigateway:*",
-						"ssm:*",
-						"autoscaling-plans:*",
-						"autoscaling:*",
-						"cloudformation:*",
-					},
-					Resources: []string{
-						"*",
-					},
-				},
-			},
-		})
-
-		ecsIAMPolicy, err := iam.NewPolicy(ctx, "pulumi-backstage-ecs-policy", &iam.PolicyArgs{
-			Policy: pulumi.String(ecsPolicyResult.Json),
-		})
-		if err != nil {
-			return err
-		}
-
-		_, err = iam.NewRolePolicyAttachment(ctx, "pulumi-backstage-ecs-role-policy-attachment", &iam.RolePolicyAttachmentArgs{
-			PolicyArn: ecsIAMPolicy.Arn,
-			Role:      ecsRole.Name,
-		})
 
 		taskExecutionResult, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
 			Statements: []iam.GetPolicyDocumentStatement{
@@ -296,6 +338,45 @@ func main() {
 			Role:      taskExecutionRole.Name,
 		})
 
+		// keep the credentials of Backstage out of the task definition, ECS injects them from Secrets Manager
+		clusterTokenSecret, clusterTokenVersion, err := newSecret(ctx, "pulumi-backstage-aws-k8s-cluster-token", "Service account token Backstage reads the GitOps cluster with",
+			infraStackRef.GetStringOutput(pulumi.String("backstage-token")))
+		if err != nil {
+			return err
+		}
+
+		pulumiTokenSecret, pulumiTokenVersion, err := newSecret(ctx, "pulumi-backstage-aws-pulumi-access-token", "Pulumi access token of Backstage", config.GetSecret(ctx, "pulumi-pat"))
+		if err != nil {
+			return err
+		}
+		// tasks started before the values are stored fail to pull the secrets
+		secretVersions := []pulumi.Resource{dbPasswordVersion, clusterTokenVersion, pulumiTokenVersion}
+
+		// ECS reads the secrets of the container when starting the task, nothing else
+		secretsPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+			Statements: iam.GetPolicyDocumentStatementArray{
+				iam.GetPolicyDocumentStatementArgs{
+					Effect: pulumi.String("Allow"),
+					Actions: pulumi.StringArray{
+						pulumi.String("secretsmanager:GetSecretValue"),
+					},
+					Resources: pulumi.StringArray{
+						dbPasswordSecret.Arn,
+						clusterTokenSecret.Arn,
+						pulumiTokenSecret.Arn,
+					},
+				},
+			},
+		})
+
+		_, err = iam.NewRolePolicy(ctx, "pulumi-backstage-ecs-task-execution-role-secrets-policy", &iam.RolePolicyArgs{
+			Role:   taskExecutionRole.Name,
+			Policy: secretsPolicy.Json(),
+		})
+		if err != nil {
+			return err
+		}
+
 		registryInfo := repository.RegistryId.ApplyT(func(id string) (docker.Registry, error) {
 			creds, err := ecr.GetCredentials(ctx, &ecr.GetCredentialsArgs{RegistryId: id})
 			if err != nil {
@@ -348,72 +429,65 @@ func main() {
 			return err
 		}
 
+		techDocsBucket, err := newTechDocsBucket(ctx)
+		if err != nil {
+			return err
+		}
+		ctx.Export("techdocs-bucket", techDocsBucket.Bucket)
+
+		// scaffolder Pulumi runs provision through a separate role, the task role only serves Backstage
+		var deployRoleCfg deployRoleConfig
+		if err := config.GetObject(ctx, "deployRole", &deployRoleCfg); err != nil {
+			return err
+		}
+		deployRoleCfg = deployRoleCfg.withDefaults()
+		deployRole, err := newDeployRole(ctx, deployRoleCfg, ecsRole)
+		if err != nil {
+			return err
+		}
+		ctx.Export("deploy-role-arn", deployRole.Arn)
+		// roles created by Pulumi runs have to use the path and the boundary
+		ctx.Export("deploy-role-path", pulumi.String(deployRolePath))
+		ctx.Export("deploy-boundary-name", pulumi.String(deployBoundaryName))
+
+		err = newTaskRolePolicy(ctx, ecsRole, taskRolePermissions{
+			logGroupArn:       logGroup.Arn,
+			techDocsBucketArn: techDocsBucket.Arn,
+			secretArns: pulumi.StringArray{
+				dbPasswordSecret.Arn,
+				clusterTokenSecret.Arn,
+				pulumiTokenSecret.Arn,
+			},
+			deployRoleArn: deployRole.Arn,
+		})
+		if err != nil {
+			return err
+		}
+
 		backstageECSTask, err := ecs.NewTaskDefinition(ctx, "pulumi-backstage-ecs-task", &ecs.TaskDefinitionArgs{
 			Family: pulumi.String("backstage"),
 			EphemeralStorage: &ecs.TaskDefinitionEphemeralStorageArgs{
 				SizeInGib: pulumi.Int(100),
 			},
-			ContainerDefinitions: pulumi.Sprintf(`[
-    {
-      "name": "app-first-task",
-      "image": "%s",
-      "essential": true,
-      "environment": [
-			{
-				"name": "POSTGRES_HOST",
-				"value": "%s"	
-			},
-			{
-				"name": "POSTGRES_PORT",
-				"value": "%d"	
-			},
-			{
-				"name": "POSTGRES_USER",	
-				"value": "backstage"	
-			},
-			{
-				"name": "POSTGRES_PASSWORD",
-				"value": "backstage"	
-			},
-			{
-				"name": "BACKSTAGE_BASE_URL",
-				"value": "http://%s"
-			},
-			{
-				"name": "WEBSITES_PORT",
-				"value": "7007"	
-			},
-			{
-				"name": "K8S_CLUSTER_URL",
-				"value": "%s"
-			},
-			{
-				"name": "K8S_CLUSTER_SA_TOKEN",
-				"value": "%s"
-			},
-			{
-				"name": "PULUMI_ACCESS_TOKEN",
-				"value": "%s"
-			}
-	  ],
-	  "logConfiguration": {
-        "logDriver": "awslogs",
-		"options": {
-			"awslogs-group": "%s",
-			"awslogs-region": "eu-central-1",
-			"awslogs-stream-prefix": "backstage"
-		}
-	  },
-      "portMappings": [
-        {
-          "containerPort": 7007,
-          "hostPort": 7007
-        }
-      ]
-    }
-  ]
-`, backstageImage.ImageName, instance.Address, instance.Port, loadBalancer.DnsName,
-				infraStackRef.GetStringOutput(pulumi.String("gitops-platform-endpoint")), infraStackRef.GetStringOutput(pulumi.String("backstage-token")), config.GetSecret(ctx, "pulumi-pat"), logGroup.Name),
+			ContainerDefinitions: pulumi.All(backstageImage.ImageName, instance.Address, instance.Port, dbPasswordSecret.Arn, baseURL,
+				infraStackRef.GetStringOutput(pulumi.String("gitops-platform-endpoint")), clusterTokenSecret.Arn, pulumiTokenSecret.Arn,
+				logGroup.Name, techDocsBucket.Bucket, deployRole.Arn).ApplyT(func(args []interface{}) (string, error) {
+				return backstageContainerDefinitions(backstageSettings{
+					Image:                args[0].(string),
+					PostgresHost:         args[1].(string),
+					PostgresPort:         args[2].(int),
+					PostgresPasswordArn:  args[3].(string),
+					BaseURL:              args[4].(string),
+					ClusterURL:           args[5].(string),
+					ClusterTokenArn:      args[6].(string),
+					PulumiAccessTokenArn: args[7].(string),
+					LogGroup:             args[8].(string),
+					TechDocsBucket:       args[9].(string),
+					DeployRoleArn:        args[10].(string),
+					DeploySessionTag:     deployRoleCfg.SessionTag,
+					Region:               "eu-central-1",
+				})
+			}).(pulumi.StringOutput),
 			RequiresCompatibilities: pulumi.StringArray{
 				pulumi.String("FARGATE"),
 			},
@@ -422,34 +496,7 @@ func main() {
 			Cpu:              pulumi.String("2048"),
 			ExecutionRoleArn: taskExecutionRole.Arn,
 			TaskRoleArn:      ecsRole.Arn,
-		})
-		if err != nil {
-			return err
-		}
-
-		fargateSecurityGroup, err := ec2.NewSecurityGroup(ctx, "pulumi-backstage-aws-fargate-service-sg", &ec2.SecurityGroupArgs{
-			VpcId: vpcId,
-			Ingress: ec2.SecurityGroupIngressArray{
-				&ec2.SecurityGroupIngressArgs{
-					Protocol: pulumi.String("-1"),
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-				},
-			},
-			Egress: ec2.SecurityGroupEgressArray{
-				&ec2.SecurityGroupEgressArgs{
-					Protocol: pulumi.String("-1"),
-					FromPort: pulumi.Int(0),
-					ToPort:   pulumi.Int(0),
-					CidrBlocks: pulumi.StringArray{
-						pulumi.String("0.0.0.0/0"),
-					},
-				},
-			},
-		})
+		}, pulumi.DependsOn(secretVersions))
 		if err != nil {
 			return err
 		}
@@ -458,28 +505,29 @@ func main() {
 			Cluster:        cluster.Arn,
 			TaskDefinition: backstageECSTask.Arn,
 			NetworkConfiguration: &ecs.ServiceNetworkConfigurationArgs{
-				Subnets:        publicSubnetIDs,
-				AssignPublicIp: pulumi.Bool(true),
+				Subnets:        appSubnetIDs,
+				AssignPublicIp: pulumi.Bool(false),
 				SecurityGroups: pulumi.StringArray{
-					fargateSecurityGroup.ID(),
+					groups.tasks.ID(),
 				},
 			},
 			LoadBalancers: ecs.ServiceLoadBalancerArray{
 				&ecs.ServiceLoadBalancerArgs{
 					TargetGroupArn: targetGroup.Arn,
-					ContainerName:  pulumi.String("app-first-task"),
-					ContainerPort:  pulumi.Int(7007),
+					ContainerName:  pulumi.String(backstageContainerName),
+					ContainerPort:  pulumi.Int(backstagePort),
 				},
 			},
 			LaunchType:         pulumi.String("FARGATE"),
 			DesiredCount:       pulumi.Int(1),
 			SchedulingStrategy: pulumi.String("REPLICA"),
-		}, pulumi.DependsOn([]pulumi.Resource{allListener}))
+		}, pulumi.DependsOn(append(listeners, secretVersions...)))
 		if err != nil {
 			return err
 		}
 
 		ctx.Export("url", loadBalancer.DnsName)
+		ctx.Export("base-url", baseURL)
 		return nil
 	})
 
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// tierTag marks our subnets, so the infra stack doesn't report them as used.
+const tierTag = "pulumi-backstage-aws/tier"
+
+// The app subnets reach the internet through a NAT gateway, or only the AWS APIs
+// through the VPC endpoints of the infra stack. Set with the `privateEgress` config key.
+const (
+	egressNat       = "nat"
+	egressEndpoints = "endpoints"
+)
+
+// newNatGateway gives the private subnets outbound access through a public subnet.
+func newNatGateway(ctx *pulumi.Context, publicSubnetID pulumi.StringInput) (*ec2.NatGateway, error) {
+	eip, err := ec2.NewEip(ctx, "pulumi-backstage-aws-nat-eip", &ec2.EipArgs{
+		Domain: pulumi.String("vpc"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ec2.NewNatGateway(ctx, "pulumi-backstage-aws-nat", &ec2.NatGatewayArgs{
+		AllocationId: eip.ID(),
+		SubnetId:     publicSubnetID,
+	})
+}
+
+// newSubnetTier creates a private subnet per availability zone, sharing a route
+// table with the given routes. Without routes the tier only reaches the VPC.
+func newSubnetTier(ctx *pulumi.Context, tier string, cidrs []string, vpcId pulumi.StringInput, routes ec2.RouteTableRouteArray) (pulumi.StringArray, *ec2.RouteTable, error) {
+	if len(cidrs) != len(availabilityZones) {
+		return nil, nil, fmt.Errorf("the %s tier needs one subnet per availability zone, got %d subnets for %d zones", tier, len(cidrs), len(availabilityZones))
+	}
+
+	rt, err := ec2.NewRouteTable(ctx, fmt.Sprintf("pulumi-backstage-aws-%s-rt", tier), &ec2.RouteTableArgs{
+		VpcId:  vpcId,
+		Routes: routes,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var subnetIDs pulumi.StringArray
+	for i, az := range availabilityZones {
+		subnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-aws-%s-subnet-%d", tier, i), &ec2.SubnetArgs{
+			VpcId:                       vpcId,
+			CidrBlock:                   pulumi.String(cidrs[i]),
+			MapPublicIpOnLaunch:         pulumi.Bool(false),
+			AssignIpv6AddressOnCreation: pulumi.Bool(false),
+			AvailabilityZone:            pulumi.String(az),
+			Tags: pulumi.StringMap{
+				"Name":  pulumi.Sprintf("pulumi-backstage-aws-subnet-%s-%s", tier, az),
+				tierTag: pulumi.String(tier),
+			},
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-aws-%s-rt-association-%s", tier, az), &ec2.RouteTableAssociationArgs{
+			RouteTableId: rt.ID(),
+			SubnetId:     subnet.ID(),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		subnetIDs = append(subnetIDs, subnet.ID())
+	}
+	return subnetIDs, rt, nil
+}
+
+// subnetLayout holds the subnets of the public, app and db tier and the route
+// tables of the private tiers.
+type subnetLayout struct {
+	subnetIDs     map[string]pulumi.StringArray
+	routeTableIds pulumi.StringArray
+}
+
+// newSubnetTiers creates the public subnets for the load balancer, the app
+// subnets with the private egress and the isolated db subnets.
+func newSubnetTiers(ctx *pulumi.Context, cidrs map[string][]string, vpcId, publicRouteTableId pulumi.StringInput, egress string) (*subnetLayout, error) {
+	var publicSubnetIDs pulumi.StringArray
+
+	// Create a public subnet for each availability zone, they only hold the load balancer
+	for i, az := range availabilityZones {
+		publicSubnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-aws-fargate-subnet-%d", i), &ec2.SubnetArgs{
+			VpcId:                       vpcId,
+			CidrBlock:                   pulumi.String(cidrs["public"][i]),
+			MapPublicIpOnLaunch:         pulumi.Bool(false),
+			AssignIpv6AddressOnCreation: pulumi.Bool(false),
+			AvailabilityZone:            pulumi.String(az),
+			Tags: pulumi.StringMap{
+				"Name":  pulumi.Sprintf("pulumi-backstage-aws-subnet-public-%s", az),
+				tierTag: pulumi.String("public"),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-aws-rt-association-%s", az), &ec2.RouteTableAssociationArgs{
+			RouteTableId: publicRouteTableId,
+			SubnetId:     publicSubnet.ID(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		publicSubnetIDs = append(publicSubnetIDs, publicSubnet.ID())
+	}
+
+	// the tasks reach the internet through a NAT gateway, the database only the VPC
+	var appRoutes ec2.RouteTableRouteArray
+	if egress == egressNat {
+		nat, err := newNatGateway(ctx, publicSubnetIDs[0])
+		if err != nil {
+			return nil, err
+		}
+		appRoutes = ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock:    pulumi.String("0.0.0.0/0"),
+				NatGatewayId: nat.ID(),
+			},
+		}
+	}
+
+	appSubnetIDs, appRouteTable, err := newSubnetTier(ctx, "app", cidrs["app"], vpcId, appRoutes)
+	if err != nil {
+		return nil, err
+	}
+
+	dbSubnetIDs, dbRouteTable, err := newSubnetTier(ctx, "db", cidrs["db"], vpcId, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &subnetLayout{
+		subnetIDs: map[string]pulumi.StringArray{
+			"public": publicSubnetIDs,
+			"app":    appSubnetIDs,
+			"db":     dbSubnetIDs,
+		},
+		routeTableIds: pulumi.StringArray{
+			appRouteTable.ID(),
+			dbRouteTable.ID(),
+		},
+	}, nil
+}
+
+// sharedS3EndpointID returns the S3 gateway endpoint of the infra stack, empty
+// when the stack has no VPC endpoints.
+func sharedS3EndpointID(infraStackRef *pulumi.StackReference) (string, error) {
+	endpoint, err := infraStackRef.GetOutputDetails("s3-endpoint-id")
+	if err != nil {
+		return "", err
+	}
+	id, _ := endpoint.Value.(string)
+	return id, nil
+}
+
+// newS3EndpointRoutes adds the route tables to the S3 gateway endpoint, so the
+// tiers reach S3 without a NAT gateway.
+func newS3EndpointRoutes(ctx *pulumi.Context, endpointId string, routeTableIds pulumi.StringArray) error {
+	for i, routeTableId := range routeTableIds {
+		_, err := ec2.NewVpcEndpointRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-aws-s3-endpoint-rt-association-%d", i), &ec2.VpcEndpointRouteTableAssociationArgs{
+			VpcEndpointId: pulumi.String(endpointId),
+			RouteTableId:  routeTableId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// existingVpcConfig is read from the `existingVpc` config key. When a VPC is
+// selected, Backstage runs in its subnets instead of creating its own.
+type existingVpcConfig struct {
+	// VpcId selects the VPC, otherwise it's looked up by Tags.
+	VpcId string            `json:"vpcId"`
+	Tags  map[string]string `json:"tags"`
+	// SubnetIds are the subnets per tier, public, app and db.
+	SubnetIds map[string][]string `json:"subnetIds"`
+	// SubnetTags look up the subnets of the tiers without SubnetIds.
+	SubnetTags map[string]map[string]string `json:"subnetTags"`
+}
+
+func (c existingVpcConfig) enabled() bool {
+	return c.VpcId != "" || len(c.Tags) > 0
+}
+
+// lookupSubnetTiers resolves the subnets of every tier in an existing VPC
+// without creating any resources. Every tier has to span availabilityZones.
+func lookupSubnetTiers(ctx *pulumi.Context, cfg existingVpcConfig) (pulumi.StringInput, map[string]pulumi.StringArray, error) {
+	vpcArgs := &ec2.LookupVpcArgs{
+		Tags: cfg.Tags,
+	}
+	if cfg.VpcId != "" {
+		vpcArgs.Id = pulumi.StringRef(cfg.VpcId)
+	}
+	vpc, err := ec2.LookupVpc(ctx, vpcArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	vpcFilter := ec2.GetSubnetsFilter{
+		Name:   "vpc-id",
+		Values: []string{vpc.Id},
+	}
+
+	subnetIDs := map[string]pulumi.StringArray{}
+	for _, tier := range subnetTiers {
+		ids, ok := cfg.SubnetIds[tier]
+		if !ok {
+			tags, ok := cfg.SubnetTags[tier]
+			if !ok {
+				return nil, nil, fmt.Errorf("existingVpc needs subnetIds or subnetTags for the %s subnets", tier)
+			}
+			tagged, err := ec2.GetSubnets(ctx, &ec2.GetSubnetsArgs{
+				Filters: []ec2.GetSubnetsFilter{vpcFilter},
+				Tags:    tags,
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			ids = tagged.Ids
+		}
+
+		subnets := map[string]*ec2.LookupSubnetResult{}
+		for _, id := range ids {
+			subnet, err := ec2.LookupSubnet(ctx, &ec2.LookupSubnetArgs{
+				Id: pulumi.StringRef(id),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			if subnet.VpcId != vpc.Id {
+				return nil, nil, fmt.Errorf("%s subnet %s is not in VPC %s", tier, id, vpc.Id)
+			}
+			subnets[id] = subnet
+		}
+		ids, err = sortSubnetsByZone(tier, vpc.Id, ids, subnets)
+		if err != nil {
+			return nil, nil, err
+		}
+		subnetIDs[tier] = pulumi.ToStringArray(ids)
+	}
+	return pulumi.String(vpc.Id), subnetIDs, nil
+}
+
+// sortSubnetsByZone orders the subnets of a tier like availabilityZones and
+// fails unless they cover every zone.
+func sortSubnetsByZone(tier, vpcId string, ids []string, subnets map[string]*ec2.LookupSubnetResult) ([]string, error) {
+	zoneIndex := map[string]int{}
+	for i, az := range availabilityZones {
+		zoneIndex[az] = i
+	}
+
+	covered := map[string]bool{}
+	for _, id := range ids {
+		az := subnets[id].AvailabilityZone
+		if _, ok := zoneIndex[az]; !ok {
+			return nil, fmt.Errorf("%s subnet %s is in %s, outside of the availability zones %s", tier, id, az, strings.Join(availabilityZones, ", "))
+		}
+		covered[az] = true
+	}
+	for _, az := range availabilityZones {
+		if !covered[az] {
+			return nil, fmt.Errorf("the %s subnets of VPC %s don't cover availability zone %s", tier, vpcId, az)
+		}
+	}
+
+	sorted := append([]string{}, ids...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return zoneIndex[subnets[sorted[i]].AvailabilityZone] < zoneIndex[subnets[sorted[j]].AvailabilityZone]
+	})
+	return sorted, nil
+}
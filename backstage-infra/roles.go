@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	deployBoundaryName     = "pulumi-backstage-deploy-boundary"
+	deployRoleBoundaryName = "pulumi-backstage-deploy-role-boundary"
+	// deployRolePath holds every role and policy Pulumi runs create, the deploy
+	// role can't touch roles or policies outside of it.
+	deployRolePath = "/backstage-deploy/"
+)
+
+// passedToServices are the principals roles of a service are passed to, where
+// they differ from <service>.amazonaws.com.
+var passedToServices = map[string][]string{
+	"ecs": {"ecs.amazonaws.com", "ecs-tasks.amazonaws.com"},
+}
+
+// deployRoleConfig is read from the `deployRole` config key.
+type deployRoleConfig struct {
+	// AllowedServices are the IAM service prefixes Pulumi runs may use, like s3 or lambda.
+	AllowedServices []string `json:"allowedServices"`
+	// SessionTag has to be passed when assuming the role, so CloudTrail
+	// attributes every change to the Backstage entity that triggered it.
+	SessionTag string `json:"sessionTag"`
+}
+
+func (c deployRoleConfig) withDefaults() deployRoleConfig {
+	if c.AllowedServices == nil {
+		c.AllowedServices = []string{
+			"apigateway",
+			"cloudformation",
+			"ec2",
+			"ecr",
+			"ecs",
+			"lambda",
+			"logs",
+			"rds",
+			"s3",
+			"ssm",
+		}
+	}
+	if c.SessionTag == "" {
+		c.SessionTag = "backstage-entity"
+	}
+	return c
+}
+
+// taskRolePermissions are the resources Backstage itself works with.
+type taskRolePermissions struct {
+	logGroupArn       pulumi.StringInput
+	techDocsBucketArn pulumi.StringInput
+	secretArns        pulumi.StringArray
+	deployRoleArn     pulumi.StringInput
+}
+
+// newTaskRolePolicy limits the task role to the logs, the TechDocs bucket and
+// the secrets of Backstage. Provisioning goes through the deploy role.
+func newTaskRolePolicy(ctx *pulumi.Context, role *iam.Role, permissions taskRolePermissions) error {
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("logs:CreateLogStream"),
+					pulumi.String("logs:PutLogEvents"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.Sprintf("%s:*", permissions.logGroupArn),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:ListBucket"),
+				},
+				Resources: pulumi.StringArray{
+					permissions.techDocsBucketArn,
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:DeleteObject"),
+					pulumi.String("s3:GetObject"),
+					pulumi.String("s3:PutObject"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.Sprintf("%s/*", permissions.techDocsBucketArn),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("secretsmanager:GetSecretValue"),
+				},
+				Resources: permissions.secretArns,
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("sts:AssumeRole"),
+					pulumi.String("sts:TagSession"),
+				},
+				Resources: pulumi.StringArray{
+					permissions.deployRoleArn,
+				},
+			},
+		},
+	})
+
+	ecsIAMPolicy, err := iam.NewPolicy(ctx, "pulumi-backstage-ecs-policy", &iam.PolicyArgs{
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicyAttachment(ctx, "pulumi-backstage-ecs-role-policy-attachment", &iam.RolePolicyAttachmentArgs{
+		PolicyArn: ecsIAMPolicy.Arn,
+		Role:      role.Name,
+	})
+	return err
+}
+
+// deployPolicies are the documents of the deploy role and the roles it creates.
+type deployPolicies struct {
+	// permissions is the inline policy of the deploy role.
+	permissions string
+	// roleBoundary caps the deploy role itself.
+	roleBoundary string
+	// boundary caps the roles the deploy role creates, they only get the allowed services.
+	boundary string
+}
+
+// newDeployPolicies allows the configured services and the management of the
+// roles and policies below deployRolePath, the roles keeping the deploy boundary,
+// so Pulumi runs can't escalate through IAM or touch roles they didn't create.
+func newDeployPolicies(ctx *pulumi.Context, cfg deployRoleConfig, accountId string) (*deployPolicies, error) {
+	boundaryArn := fmt.Sprintf("arn:aws:iam::%s:policy/%s", accountId, deployBoundaryName)
+	roleBoundaryArn := fmt.Sprintf("arn:aws:iam::%s:policy/%s", accountId, deployRoleBoundaryName)
+	deployRoles := fmt.Sprintf("arn:aws:iam::%s:role%s*", accountId, deployRolePath)
+	deployRolePolicies := fmt.Sprintf("arn:aws:iam::%s:policy%s*", accountId, deployRolePath)
+
+	services := make([]string, 0, len(cfg.AllowedServices))
+	var principals []string
+	for _, service := range cfg.AllowedServices {
+		services = append(services, service+":*")
+		if servicePrincipals, ok := passedToServices[service]; ok {
+			principals = append(principals, servicePrincipals...)
+		} else {
+			principals = append(principals, service+".amazonaws.com")
+		}
+	}
+
+	allowServices := iam.GetPolicyDocumentStatement{
+		Effect:    pulumi.StringRef("Allow"),
+		Actions:   services,
+		Resources: []string{"*"},
+	}
+	manageRoles := iam.GetPolicyDocumentStatement{
+		Effect: pulumi.StringRef("Allow"),
+		Actions: []string{
+			"iam:AttachRolePolicy",
+			"iam:CreateRole",
+			"iam:DeleteRolePolicy",
+			"iam:DetachRolePolicy",
+			"iam:PutRolePermissionsBoundary",
+			"iam:PutRolePolicy",
+		},
+		Resources: []string{deployRoles},
+		Conditions: []iam.GetPolicyDocumentStatementCondition{
+			{
+				Test:     "StringEquals",
+				Variable: "iam:PermissionsBoundary",
+				Values:   []string{boundaryArn},
+			},
+		},
+	}
+	maintainRoles := iam.GetPolicyDocumentStatement{
+		Effect: pulumi.StringRef("Allow"),
+		Actions: []string{
+			"iam:DeleteRole",
+			"iam:GetRole",
+			"iam:GetRolePolicy",
+			"iam:ListAttachedRolePolicies",
+			"iam:ListInstanceProfilesForRole",
+			"iam:ListRolePolicies",
+			"iam:TagRole",
+			"iam:UntagRole",
+			// the trust policy can't widen the permissions, the boundary caps them
+			"iam:UpdateAssumeRolePolicy",
+			"iam:UpdateRole",
+			"iam:UpdateRoleDescription",
+		},
+		Resources: []string{deployRoles},
+	}
+	// managed policies only take effect on deploy roles, where the boundary caps them
+	managePolicies := iam.GetPolicyDocumentStatement{
+		Effect: pulumi.StringRef("Allow"),
+		Actions: []string{
+			"iam:CreatePolicy",
+			"iam:CreatePolicyVersion",
+			"iam:DeletePolicy",
+			"iam:DeletePolicyVersion",
+			"iam:GetPolicy",
+			"iam:GetPolicyVersion",
+			"iam:ListEntitiesForPolicy",
+			"iam:ListPolicyVersions",
+			"iam:TagPolicy",
+			"iam:UntagPolicy",
+		},
+		Resources: []string{deployRolePolicies},
+	}
+	passRoles := iam.GetPolicyDocumentStatement{
+		Effect:    pulumi.StringRef("Allow"),
+		Actions:   []string{"iam:PassRole"},
+		Resources: []string{deployRoles},
+		Conditions: []iam.GetPolicyDocumentStatementCondition{
+			{
+				Test:     "StringEquals",
+				Variable: "iam:PassedToService",
+				Values:   principals,
+			},
+		},
+	}
+	protectBoundaries := []iam.GetPolicyDocumentStatement{
+		{
+			Effect:    pulumi.StringRef("Deny"),
+			Actions:   []string{"iam:DeleteRolePermissionsBoundary"},
+			Resources: []string{"*"},
+		},
+		{
+			Effect: pulumi.StringRef("Deny"),
+			Actions: []string{
+				"iam:CreatePolicyVersion",
+				"iam:DeletePolicy",
+				"iam:DeletePolicyVersion",
+				"iam:SetDefaultPolicyVersion",
+			},
+			Resources: []string{boundaryArn, roleBoundaryArn},
+		},
+	}
+
+	// the deploy role is capped to the deploy roles too, so a policy attached to
+	// it can't reach beyond them
+	capRoles := manageRoles
+	capRoles.Conditions = nil
+
+	documents := map[string][]iam.GetPolicyDocumentStatement{
+		"permissions":  append([]iam.GetPolicyDocumentStatement{allowServices, manageRoles, maintainRoles, managePolicies, passRoles}, protectBoundaries...),
+		"roleBoundary": append([]iam.GetPolicyDocumentStatement{allowServices, capRoles, maintainRoles, managePolicies, passRoles}, protectBoundaries...),
+		"boundary":     {allowServices},
+	}
+
+	rendered := map[string]string{}
+	for name, statements := range documents {
+		policy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+			Statements: statements,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rendered[name] = policy.Json
+	}
+	return &deployPolicies{
+		permissions:  rendered["permissions"],
+		roleBoundary: rendered["roleBoundary"],
+		boundary:     rendered["boundary"],
+	}, nil
+}
+
+// newDeployRole creates the role scaffolder Pulumi runs assume from the task
+// role. The role and every role it creates are capped by a permissions boundary,
+// the created roles have to live below deployRolePath.
+func newDeployRole(ctx *pulumi.Context, cfg deployRoleConfig, taskRole *iam.Role) (*iam.Role, error) {
+	identity, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := newDeployPolicies(ctx, cfg, identity.AccountId)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewPolicy(ctx, "pulumi-backstage-deploy-boundary", &iam.PolicyArgs{
+		Name:   pulumi.String(deployBoundaryName),
+		Policy: pulumi.String(policies.boundary),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	roleBoundary, err := iam.NewPolicy(ctx, "pulumi-backstage-deploy-role-boundary", &iam.PolicyArgs{
+		Name:   pulumi.String(deployRoleBoundaryName),
+		Policy: pulumi.String(policies.roleBoundary),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the task role may only assume the role with the session tag set
+	assumeRolePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("sts:AssumeRole"),
+					pulumi.String("sts:TagSession"),
+				},
+				Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+					iam.GetPolicyDocumentStatementPrincipalArgs{
+						Type: pulumi.String("AWS"),
+						Identifiers: pulumi.StringArray{
+							taskRole.Arn,
+						},
+					},
+				},
+				Conditions: iam.GetPolicyDocumentStatementConditionArray{
+					iam.GetPolicyDocumentStatementConditionArgs{
+						Test:     pulumi.String("StringLike"),
+						Variable: pulumi.String("aws:RequestTag/" + cfg.SessionTag),
+						Values: pulumi.StringArray{
+							pulumi.String("?*"),
+						},
+					},
+				},
+			},
+		},
+	})
+
+	deployRole, err := iam.NewRole(ctx, "pulumi-backstage-deploy-role", &iam.RoleArgs{
+		AssumeRolePolicy:    assumeRolePolicy.Json(),
+		PermissionsBoundary: roleBoundary.Arn,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "pulumi-backstage-deploy-role-policy", &iam.RolePolicyArgs{
+		Role:   deployRole.Name,
+		Policy: pulumi.String(policies.permissions),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deployRole, nil
+}
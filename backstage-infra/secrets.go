@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/secretsmanager"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// newSecret stores a value in Secrets Manager, so the task definition only
+// references it by ARN and ECS injects it when starting the task. Tasks must
+// depend on the returned version, the secret alone exists before its value.
+func newSecret(ctx *pulumi.Context, name, description string, value pulumi.StringInput) (*secretsmanager.Secret, *secretsmanager.SecretVersion, error) {
+	secret, err := secretsmanager.NewSecret(ctx, name+"-secret", &secretsmanager.SecretArgs{
+		Description: pulumi.String(description),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, err := secretsmanager.NewSecretVersion(ctx, name+"-secret-version", &secretsmanager.SecretVersionArgs{
+		SecretId:     secret.ID(),
+		SecretString: value,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, version, nil
+}
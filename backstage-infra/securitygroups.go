@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const postgresPort = 5432
+
+// securityGroupConfig is read from the `securityGroups` config key.
+type securityGroupConfig struct {
+	// IngressCidrs may reach the load balancer on 80 and 443.
+	IngressCidrs []string `json:"ingressCidrs"`
+	// AdminDatabaseCidrs may reach Postgres directly, like a VPN or a bastion host.
+	AdminDatabaseCidrs []string `json:"adminDatabaseCidrs"`
+	// AdminTaskCidrs may reach the Backstage tasks without going through the load balancer.
+	AdminTaskCidrs []string `json:"adminTaskCidrs"`
+}
+
+func (c securityGroupConfig) withDefaults() securityGroupConfig {
+	if c.IngressCidrs == nil {
+		c.IngressCidrs = []string{"0.0.0.0/0"}
+	}
+	return c
+}
+
+// securityGroups chain the tiers: the internet reaches the load balancer, the
+// load balancer the tasks and the tasks the database.
+type securityGroups struct {
+	alb      *ec2.SecurityGroup
+	tasks    *ec2.SecurityGroup
+	database *ec2.SecurityGroup
+}
+
+// securityGroupRule opens a TCP port of a group to either CIDRs or another group.
+type securityGroupRule struct {
+	name        string
+	group       *ec2.SecurityGroup
+	ruleType    string
+	port        int
+	cidrs       []string
+	sourceGroup *ec2.SecurityGroup
+	description string
+}
+
+// newSecurityGroups creates the groups of the load balancer, the tasks and the
+// database. The rules are separate resources, as the groups reference each other.
+func newSecurityGroups(ctx *pulumi.Context, cfg securityGroupConfig, vpcId pulumi.StringInput) (*securityGroups, error) {
+	alb, err := ec2.NewSecurityGroup(ctx, "pulumi-backstage-aws-alb-sg", &ec2.SecurityGroupArgs{
+		VpcId:       vpcId,
+		Description: pulumi.String("Backstage load balancer"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := ec2.NewSecurityGroup(ctx, "pulumi-backstage-aws-task-sg", &ec2.SecurityGroupArgs{
+		VpcId:       vpcId,
+		Description: pulumi.String("Backstage tasks"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := ec2.NewSecurityGroup(ctx, "pulumi-backstage-aws-db-sg", &ec2.SecurityGroupArgs{
+		VpcId:       vpcId,
+		Description: pulumi.String("Backstage database"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rules := []securityGroupRule{
+		{name: "alb-ingress-http", group: alb, ruleType: "ingress", port: 80, cidrs: cfg.IngressCidrs, description: "HTTP from the allowed networks"},
+		{name: "alb-ingress-https", group: alb, ruleType: "ingress", port: 443, cidrs: cfg.IngressCidrs, description: "HTTPS from the allowed networks"},
+		{name: "alb-egress-tasks", group: alb, ruleType: "egress", port: backstagePort, sourceGroup: tasks, description: "Backstage tasks"},
+		{name: "task-ingress-alb", group: tasks, ruleType: "ingress", port: backstagePort, sourceGroup: alb, description: "Backstage from the load balancer"},
+		{name: "task-ingress-admin", group: tasks, ruleType: "ingress", port: backstagePort, cidrs: cfg.AdminTaskCidrs, description: "Backstage from the admin networks"},
+		{name: "db-ingress-tasks", group: database, ruleType: "ingress", port: postgresPort, sourceGroup: tasks, description: "Postgres from the Backstage tasks"},
+		{name: "db-ingress-admin", group: database, ruleType: "ingress", port: postgresPort, cidrs: cfg.AdminDatabaseCidrs, description: "Postgres from the admin networks"},
+	}
+	for _, rule := range rules {
+		args := &ec2.SecurityGroupRuleArgs{
+			SecurityGroupId: rule.group.ID(),
+			Type:            pulumi.String(rule.ruleType),
+			Protocol:        pulumi.String("tcp"),
+			FromPort:        pulumi.Int(rule.port),
+			ToPort:          pulumi.Int(rule.port),
+			Description:     pulumi.String(rule.description),
+		}
+		switch {
+		case rule.sourceGroup != nil:
+			args.SourceSecurityGroupId = rule.sourceGroup.ID()
+		case len(rule.cidrs) > 0:
+			args.CidrBlocks = pulumi.ToStringArray(rule.cidrs)
+		default:
+			// an empty allow-list opens nothing
+			continue
+		}
+		_, err := ec2.NewSecurityGroupRule(ctx, fmt.Sprintf("pulumi-backstage-aws-sg-%s", rule.name), args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the tasks pull images, read secrets and call the cluster and the Pulumi Cloud
+	_, err = ec2.NewSecurityGroupRule(ctx, "pulumi-backstage-aws-sg-task-egress-all", &ec2.SecurityGroupRuleArgs{
+		SecurityGroupId: tasks.ID(),
+		Type:            pulumi.String("egress"),
+		Protocol:        pulumi.String("-1"),
+		FromPort:        pulumi.Int(0),
+		ToPort:          pulumi.Int(0),
+		CidrBlocks: pulumi.StringArray{
+			pulumi.String("0.0.0.0/0"),
+		},
+		Description: pulumi.String("Outbound traffic of the Backstage tasks"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &securityGroups{
+		alb:      alb,
+		tasks:    tasks,
+		database: database,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// newTechDocsBucket creates the private, encrypted bucket Backstage publishes TechDocs to.
+func newTechDocsBucket(ctx *pulumi.Context) (*s3.BucketV2, error) {
+	bucket, err := s3.NewBucketV2(ctx, "pulumi-backstage-techdocs", &s3.BucketV2Args{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3.NewBucketPublicAccessBlock(ctx, "pulumi-backstage-techdocs-public-access-block", &s3.BucketPublicAccessBlockArgs{
+		Bucket:                bucket.ID(),
+		BlockPublicAcls:       pulumi.Bool(true),
+		BlockPublicPolicy:     pulumi.Bool(true),
+		IgnorePublicAcls:      pulumi.Bool(true),
+		RestrictPublicBuckets: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s3.NewBucketServerSideEncryptionConfigurationV2(ctx, "pulumi-backstage-techdocs-encryption", &s3.BucketServerSideEncryptionConfigurationV2Args{
+		Bucket: bucket.ID(),
+		Rules: s3.BucketServerSideEncryptionConfigurationV2RuleArray{
+			&s3.BucketServerSideEncryptionConfigurationV2RuleArgs{
+				ApplyServerSideEncryptionByDefault: &s3.BucketServerSideEncryptionConfigurationV2RuleApplyServerSideEncryptionByDefaultArgs{
+					SseAlgorithm: pulumi.String("AES256"),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/acm"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/alb"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/route53"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// tlsPolicy only negotiates TLS 1.3 and TLS 1.2 with forward secrecy and AEAD ciphers.
+const tlsPolicy = "ELBSecurityPolicy-TLS13-1-2-Res-2021-06"
+
+// lookupZoneID returns the ID of the public Route53 zone. Without a zone name,
+// the zone of the parent domain is used.
+func lookupZoneID(ctx *pulumi.Context, domain, zoneName string) (string, error) {
+	if zoneName == "" {
+		parts := strings.SplitN(domain, ".", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("cannot derive the DNS zone of %q, set dnsZone", domain)
+		}
+		zoneName = parts[1]
+	}
+	zone, err := route53.LookupZone(ctx, &route53.LookupZoneArgs{
+		Name:        pulumi.StringRef(zoneName),
+		PrivateZone: pulumi.BoolRef(false),
+	})
+	if err != nil {
+		return "", err
+	}
+	return zone.ZoneId, nil
+}
+
+// newValidatedCertificate issues an ACM certificate for the domain and
+// validates it with a DNS record in the zone. The returned ARN resolves once
+// the certificate is issued.
+func newValidatedCertificate(ctx *pulumi.Context, domain, zoneID string) (pulumi.StringOutput, error) {
+	certificate, err := acm.NewCertificate(ctx, "pulumi-backstage-aws-certificate", &acm.CertificateArgs{
+		DomainName:       pulumi.String(domain),
+		ValidationMethod: pulumi.String("DNS"),
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	validationOption := certificate.DomainValidationOptions.Index(pulumi.Int(0))
+	validationRecord, err := route53.NewRecord(ctx, "pulumi-backstage-aws-certificate-validation-record", &route53.RecordArgs{
+		ZoneId: pulumi.String(zoneID),
+		Name:   validationOption.ResourceRecordName().Elem(),
+		Type:   validationOption.ResourceRecordType().Elem(),
+		Records: pulumi.StringArray{
+			validationOption.ResourceRecordValue().Elem(),
+		},
+		Ttl:            pulumi.Int(60),
+		AllowOverwrite: pulumi.Bool(true),
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	validation, err := acm.NewCertificateValidation(ctx, "pulumi-backstage-aws-certificate-validation", &acm.CertificateValidationArgs{
+		CertificateArn: certificate.Arn,
+		ValidationRecordFqdns: pulumi.StringArray{
+			validationRecord.Fqdn,
+		},
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	return validation.CertificateArn, nil
+}
+
+// newAliasRecord points the domain at the load balancer.
+func newAliasRecord(ctx *pulumi.Context, domain, zoneID string, loadBalancer *alb.LoadBalancer) error {
+	_, err := route53.NewRecord(ctx, "pulumi-backstage-aws-alias-record", &route53.RecordArgs{
+		ZoneId: pulumi.String(zoneID),
+		Name:   pulumi.String(domain),
+		Type:   pulumi.String("A"),
+		Aliases: route53.RecordAliasArray{
+			&route53.RecordAliasArgs{
+				Name:                 loadBalancer.DnsName,
+				ZoneId:               loadBalancer.ZoneId,
+				EvaluateTargetHealth: pulumi.Bool(true),
+			},
+		},
+	})
+	return err
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awseks "github.com/pulumi/pulumi-aws/sdk/v6/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	storagev1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/storage/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	ebsCSIAddon          = "aws-ebs-csi-driver"
+	ebsCSIServiceAccount = "ebs-csi-controller-sa"
+)
+
+// addonConfig is a single entry of the `eksAddons` config map, keyed by the add-on name.
+type addonConfig struct {
+	// Version pins the add-on version, EKS picks its default version when empty.
+	Version string `json:"version"`
+	// ConfigurationValues must match the schema of `aws eks describe-addon-configuration`.
+	ConfigurationValues map[string]interface{} `json:"configurationValues"`
+	// ResolveConflicts is either OVERWRITE, PRESERVE or NONE.
+	ResolveConflicts string `json:"resolveConflicts"`
+}
+
+// defaultAddons are managed when the `eksAddons` config key is not set.
+func defaultAddons() map[string]addonConfig {
+	return map[string]addonConfig{
+		"vpc-cni":    {},
+		"coredns":    {},
+		"kube-proxy": {},
+		ebsCSIAddon:  {},
+	}
+}
+
+// addonVersionsURL is the endpoint of the EKS DescribeAddonVersions API.
+const addonVersionsURL = "https://eks.%s.amazonaws.com/addons/supported-versions"
+
+// emptyPayloadHash is the SHA-256 of the empty body of GET requests.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// addonVersionsPage is a page of the DescribeAddonVersions response.
+type addonVersionsPage struct {
+	Addons []struct {
+		AddonVersions []struct {
+			AddonVersion string `json:"addonVersion"`
+		} `json:"addonVersions"`
+	} `json:"addons"`
+	NextToken string `json:"nextToken"`
+}
+
+// compatibleAddonVersions lists every version of the add-on EKS offers for the
+// Kubernetes version. The provider only looks up the default and the most recent
+// one, so it calls DescribeAddonVersions with the default AWS credential chain.
+func compatibleAddonVersions(ctx context.Context, name, eksVersion string) ([]string, error) {
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	query := url.Values{
+		"addonName":         {name},
+		"kubernetesVersion": {eksVersion},
+	}
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(addonVersionsURL, region)+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		err = v4.NewSigner().SignHTTP(ctx, credentials, req, emptyPayloadHash, "eks", region, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("describing the versions of add-on %s: %s: %s", name, resp.Status, body)
+		}
+
+		var page addonVersionsPage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, err
+		}
+		for _, addon := range page.Addons {
+			for _, version := range addon.AddonVersions {
+				versions = append(versions, version.AddonVersion)
+			}
+		}
+		if page.NextToken == "" {
+			return versions, nil
+		}
+		query.Set("nextToken", page.NextToken)
+	}
+}
+
+// checkAddonVersion warns when the pinned add-on version is not offered for the
+// given Kubernetes version, and returns whether it is compatible.
+func checkAddonVersion(ctx *pulumi.Context, name string, addon addonConfig, eksVersion string) (bool, error) {
+	if addon.Version == "" {
+		return true, nil
+	}
+	versions, err := compatibleAddonVersions(ctx.Context(), name, eksVersion)
+	if err != nil {
+		return false, err
+	}
+	if len(versions) == 0 {
+		return false, ctx.Log.Warn(fmt.Sprintf("add-on %s is not available for Kubernetes %s", name, eksVersion), nil)
+	}
+	for _, version := range versions {
+		if version == addon.Version {
+			return true, nil
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) > 0
+	})
+	return false, ctx.Log.Warn(fmt.Sprintf("add-on %s %s is not compatible with Kubernetes %s, pin one of %s",
+		name, addon.Version, eksVersion, strings.Join(versions, ", ")), nil)
+}
+
+// installAddons creates the EKS managed add-ons. The EBS CSI driver gets an
+// IRSA role and an encrypted gp3 storage class that replaces gp2 as the cluster default.
+func installAddons(ctx *pulumi.Context, addons map[string]addonConfig, eksVersion string, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (map[string]*awseks.Addon, error) {
+	names := make([]string, 0, len(addons))
+	for name := range addons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	installed := map[string]*awseks.Addon{}
+	for _, name := range names {
+		addon := addons[name]
+		if ctx.DryRun() {
+			if _, err := checkAddonVersion(ctx, name, addon, eksVersion); err != nil {
+				return nil, err
+			}
+		}
+
+		resolveConflicts := addon.ResolveConflicts
+		if resolveConflicts == "" {
+			resolveConflicts = "OVERWRITE"
+		}
+		// EKS only accepts PRESERVE on update, on create it keeps the fields as well with NONE
+		resolveConflictsOnCreate := resolveConflicts
+		if resolveConflictsOnCreate == "PRESERVE" {
+			resolveConflictsOnCreate = "NONE"
+		}
+		args := &awseks.AddonArgs{
+			ClusterName:              cluster.EksCluster.Name(),
+			AddonName:                pulumi.String(name),
+			ResolveConflictsOnCreate: pulumi.String(resolveConflictsOnCreate),
+			ResolveConflictsOnUpdate: pulumi.String(resolveConflicts),
+		}
+		if addon.Version != "" {
+			args.AddonVersion = pulumi.String(addon.Version)
+		}
+		if len(addon.ConfigurationValues) > 0 {
+			values, err := json.Marshal(addon.ConfigurationValues)
+			if err != nil {
+				return nil, err
+			}
+			args.ConfigurationValues = pulumi.String(string(values))
+		}
+
+		if name == ebsCSIAddon {
+			role, err := newIRSARole(ctx, "ebs-csi-role", cluster, "kube-system", ebsCSIServiceAccount)
+			if err != nil {
+				return nil, err
+			}
+			_, err = iam.NewRolePolicyAttachment(ctx, "ebs-csi-role-attachment", &iam.RolePolicyAttachmentArgs{
+				PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AmazonEBSCSIDriverPolicy"),
+				Role:      role.Name,
+			})
+			if err != nil {
+				return nil, err
+			}
+			args.ServiceAccountRoleArn = role.Arn
+		}
+
+		created, err := awseks.NewAddon(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-addon", name), args, opts...)
+		if err != nil {
+			return nil, err
+		}
+		installed[name] = created
+	}
+
+	if ebsCSI, ok := installed[ebsCSIAddon]; ok {
+		// EKS creates gp2 as the default class, two defaults make the pick ambiguous
+		_, err := storagev1.NewStorageClassPatch(ctx, "pulumi-backstage-flux-gitops-aws-gp2-storage-class-patch", &storagev1.StorageClassPatchArgs{
+			Metadata: &metav1.ObjectMetaPatchArgs{
+				Name: pulumi.String("gp2"),
+				Annotations: pulumi.StringMap{
+					"storageclass.kubernetes.io/is-default-class": pulumi.String("false"),
+					"pulumi.com/patchForce":                       pulumi.String("true"),
+				},
+			},
+		}, pulumi.Provider(provider))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = storagev1.NewStorageClass(ctx, "pulumi-backstage-flux-gitops-aws-gp3-storage-class", &storagev1.StorageClassArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name: pulumi.String("gp3"),
+				Annotations: pulumi.StringMap{
+					"storageclass.kubernetes.io/is-default-class": pulumi.String("true"),
+				},
+			},
+			Provisioner:          pulumi.String("ebs.csi.aws.com"),
+			VolumeBindingMode:    pulumi.String("WaitForFirstConsumer"),
+			AllowVolumeExpansion: pulumi.Bool(true),
+			Parameters: pulumi.StringMap{
+				"type":      pulumi.String("gp3"),
+				"encrypted": pulumi.String("true"),
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{ebsCSI}))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return installed, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/apiextensions"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	certManagerNamespace      = "cert-manager"
+	certManagerServiceAccount = "cert-manager"
+	pcaIssuerServiceAccount   = "aws-privateca-issuer"
+)
+
+var letsEncryptServers = map[string]string{
+	"letsencrypt-staging":    "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"letsencrypt-production": "https://acme-v02.api.letsencrypt.org/directory",
+}
+
+// certManagerConfig is read from the `certManager` config key.
+type certManagerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Email is the ACME account contact for the Let's Encrypt issuers.
+	Email string `json:"email"`
+	// AcmPcaArn switches from Let's Encrypt to an ACM Private CA issuer.
+	AcmPcaArn string `json:"acmPcaArn"`
+}
+
+// installCertManager deploys cert-manager and the cluster issuers. Without an
+// ACM Private CA, Let's Encrypt staging and production issuers are created that
+// solve DNS-01 challenges in the given zone. It returns the issuer names.
+func installCertManager(ctx *pulumi.Context, cfg certManagerConfig, cluster *eks.Cluster, zone *hostedZone, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (pulumi.StringArray, error) {
+	if cfg.AcmPcaArn == "" && zone == nil {
+		return nil, fmt.Errorf("cert-manager with Let's Encrypt issuers needs a dnsZone to solve DNS-01 challenges")
+	}
+	if cfg.AcmPcaArn == "" && cfg.Email == "" {
+		return nil, fmt.Errorf("cert-manager with Let's Encrypt issuers needs certManager.email")
+	}
+
+	role, err := newIRSARole(ctx, "cert-manager-role", cluster, certManagerNamespace, certManagerServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	if zone != nil {
+		policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+			Statements: iam.GetPolicyDocumentStatementArray{
+				iam.GetPolicyDocumentStatementArgs{
+					Effect: pulumi.String("Allow"),
+					Actions: pulumi.StringArray{
+						pulumi.String("route53:GetChange"),
+					},
+					Resources: pulumi.StringArray{
+						pulumi.String("arn:aws:route53:::change/*"),
+					},
+				},
+				iam.GetPolicyDocumentStatementArgs{
+					Effect: pulumi.String("Allow"),
+					Actions: pulumi.StringArray{
+						pulumi.String("route53:ChangeResourceRecordSets"),
+						pulumi.String("route53:ListResourceRecordSets"),
+					},
+					Resources: pulumi.StringArray{
+						zone.Arn,
+					},
+				},
+				iam.GetPolicyDocumentStatementArgs{
+					Effect: pulumi.String("Allow"),
+					Actions: pulumi.StringArray{
+						pulumi.String("route53:ListHostedZonesByName"),
+					},
+					Resources: pulumi.StringArray{
+						pulumi.String("*"),
+					},
+				},
+			},
+		})
+
+		_, err = iam.NewRolePolicy(ctx, "cert-manager-role-policy", &iam.RolePolicyArgs{
+			Role:   role.Name,
+			Policy: policy.Json(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certManager, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-cert-manager", &helm.ReleaseArgs{
+		Chart:           pulumi.String("cert-manager"),
+		Namespace:       pulumi.String(certManagerNamespace),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("v1.14.4"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://charts.jetstack.io"),
+		},
+		Values: pulumi.Map{
+			"installCRDs":  pulumi.Bool(true),
+			"replicaCount": pulumi.Int(platformReplicas),
+			"global": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"cainjector": pulumi.Map{
+				"replicaCount": pulumi.Int(platformReplicas),
+			},
+			"webhook": pulumi.Map{
+				"replicaCount": pulumi.Int(platformReplicas),
+			},
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(certManagerServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = newDisruptionBudgets(ctx, certManager.Namespace.Elem(), "app.kubernetes.io/name", []string{"cert-manager", "cainjector", "webhook"}, platformReplicas, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.AcmPcaArn != "" {
+		name, err := installPrivateCAIssuer(ctx, cfg.AcmPcaArn, cluster, certManager, provider, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return pulumi.StringArray{name}, nil
+	}
+
+	var issuers pulumi.StringArray
+	for _, name := range []string{"letsencrypt-staging", "letsencrypt-production"} {
+		issuer, err := apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-issuer", name), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("cert-manager.io/v1"),
+			Kind:       pulumi.String("ClusterIssuer"),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name: pulumi.String(name),
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": pulumi.Map{
+					"acme": pulumi.Map{
+						"email":  pulumi.String(cfg.Email),
+						"server": pulumi.String(letsEncryptServers[name]),
+						"privateKeySecretRef": pulumi.Map{
+							"name": pulumi.Sprintf("%s-account-key", name),
+						},
+						"solvers": pulumi.Array{
+							pulumi.Map{
+								"selector": pulumi.Map{
+									"dnsZones": pulumi.StringArray{
+										pulumi.String(zone.Name),
+									},
+								},
+								"dns01": pulumi.Map{
+									"route53": pulumi.Map{
+										"region":       pulumi.String(region),
+										"hostedZoneID": zone.ID,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{certManager}))
+		if err != nil {
+			return nil, err
+		}
+		issuers = append(issuers, issuer.Metadata.Name().Elem())
+	}
+	return issuers, nil
+}
+
+// installPrivateCAIssuer deploys the AWS Private CA issuer plugin for
+// cert-manager and a cluster issuer backed by the given certificate authority.
+func installPrivateCAIssuer(ctx *pulumi.Context, caArn string, cluster *eks.Cluster, certManager *helm.Release, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (pulumi.StringInput, error) {
+	role, err := newIRSARole(ctx, "aws-privateca-issuer-role", cluster, certManagerNamespace, pcaIssuerServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+		Statements: []iam.GetPolicyDocumentStatement{
+			{
+				Effect: pulumi.StringRef("Allow"),
+				Actions: []string{
+					"acm-pca:DescribeCertificateAuthority",
+					"acm-pca:GetCertificate",
+					"acm-pca:IssueCertificate",
+				},
+				Resources: []string{
+					caArn,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "aws-privateca-issuer-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: pulumi.String(policy.Json),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pcaIssuer, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-aws-privateca-issuer", &helm.ReleaseArgs{
+		Chart:     pulumi.String("aws-privateca-issuer"),
+		Namespace: certManager.Namespace,
+		Version:   pulumi.String("v1.2.7"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://cert-manager.github.io/aws-privateca-issuer"),
+		},
+		Values: pulumi.Map{
+			"priorityClassName": pulumi.String(platformPriorityClass),
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(pcaIssuerServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = newDisruptionBudgets(ctx, pcaIssuer.Namespace.Elem(), "app.kubernetes.io/name", []string{"aws-privateca-issuer"}, 1, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := apiextensions.NewCustomResource(ctx, "pulumi-backstage-flux-gitops-aws-aws-pca-issuer", &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("awspca.cert-manager.io/v1beta1"),
+		Kind:       pulumi.String("AWSPCAClusterIssuer"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String("aws-pca"),
+		},
+		OtherFields: kubernetes.UntypedArgs{
+			"spec": pulumi.Map{
+				"arn":    pulumi.String(caArn),
+				"region": pulumi.String(region),
+			},
+		},
+	}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{pcaIssuer}))
+	if err != nil {
+		return nil, err
+	}
+	return issuer.Metadata.Name().Elem(), nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/kms"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// controlPlaneConfig is read from the `controlPlane` config key. It has to
+// either list the CIDRs of the public API endpoint or make it private, the
+// rest defaults to audit logging and a Pulumi-managed KMS key for the
+// envelope encryption of Secrets.
+type controlPlaneConfig struct {
+	// LogTypes are the control-plane log types sent to CloudWatch.
+	LogTypes []string `json:"logTypes"`
+	// LogRetentionInDays is the retention of the control-plane log group.
+	LogRetentionInDays int `json:"logRetentionInDays"`
+	// KmsKeyArn is used for the envelope encryption of Secrets instead of a Pulumi-created key.
+	KmsKeyArn string `json:"kmsKeyArn"`
+	// PublicAccessCidrs limit the public API endpoint to these CIDRs, e.g. the
+	// egress of the CI runners and the office running Pulumi.
+	PublicAccessCidrs []string `json:"publicAccessCidrs"`
+	// PrivateOnly disables the public API endpoint. Pulumi then has to run inside
+	// the VPC, as it deploys the Kubernetes resources through the endpoint.
+	PrivateOnly bool `json:"privateOnly"`
+}
+
+func (c controlPlaneConfig) withDefaults() controlPlaneConfig {
+	if c.LogTypes == nil {
+		c.LogTypes = []string{"api", "audit", "authenticator"}
+	}
+	if c.LogRetentionInDays == 0 {
+		c.LogRetentionInDays = 30
+	}
+	return c
+}
+
+// validate fails the preview on endpoint settings that lock Pulumi out of the cluster.
+func (c controlPlaneConfig) validate() error {
+	if c.PrivateOnly && len(c.PublicAccessCidrs) > 0 {
+		return fmt.Errorf("controlPlane.publicAccessCidrs has no effect with controlPlane.privateOnly")
+	}
+	if !c.PrivateOnly && len(c.PublicAccessCidrs) == 0 {
+		return fmt.Errorf("set controlPlane.publicAccessCidrs to the CIDRs Pulumi reaches the API endpoint from, or controlPlane.privateOnly when Pulumi runs inside the VPC")
+	}
+	return nil
+}
+
+// worldOpen returns whether the public API endpoint accepts every address.
+func (c controlPlaneConfig) worldOpen() bool {
+	for _, cidr := range c.PublicAccessCidrs {
+		if cidr == "0.0.0.0/0" {
+			return true
+		}
+	}
+	return false
+}
+
+// newControlPlaneResources creates the CloudWatch log group the control plane
+// writes to and, unless one is supplied, the KMS key for Secrets encryption.
+// The log group must exist before the cluster, otherwise EKS creates it
+// without a retention.
+func newControlPlaneResources(ctx *pulumi.Context, cfg controlPlaneConfig) (*cloudwatch.LogGroup, pulumi.StringInput, error) {
+	logGroup, err := cloudwatch.NewLogGroup(ctx, "pulumi-backstage-flux-gitops-aws-cluster-log-group", &cloudwatch.LogGroupArgs{
+		Name:            pulumi.String(fmt.Sprintf("/aws/eks/%s/cluster", clusterName)),
+		RetentionInDays: pulumi.Int(cfg.LogRetentionInDays),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.KmsKeyArn != "" {
+		return logGroup, pulumi.String(cfg.KmsKeyArn), nil
+	}
+
+	key, err := kms.NewKey(ctx, "pulumi-backstage-flux-gitops-aws-secrets-key", &kms.KeyArgs{
+		Description:       pulumi.String(fmt.Sprintf("Envelope encryption of Secrets in the %s cluster", clusterName)),
+		EnableKeyRotation: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = kms.NewAlias(ctx, "pulumi-backstage-flux-gitops-aws-secrets-key-alias", &kms.AliasArgs{
+		Name:        pulumi.String(fmt.Sprintf("alias/%s-secrets", clusterName)),
+		TargetKeyId: key.KeyId,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return logGroup, key.Arn, nil
+}
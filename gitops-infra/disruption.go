@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	policyv1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/policy/v1"
+	schedulingv1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/scheduling/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// platformPriorityClass is assigned to the pods of every platform component,
+// so they are rescheduled ahead of workloads when nodes are drained.
+const platformPriorityClass = "platform-critical"
+
+// newPlatformPriorityClass creates the PriorityClass of the platform components.
+func newPlatformPriorityClass(ctx *pulumi.Context, provider pulumi.ProviderResource) (*schedulingv1.PriorityClass, error) {
+	return schedulingv1.NewPriorityClass(ctx, "pulumi-backstage-flux-gitops-aws-platform-priority-class", &schedulingv1.PriorityClassArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String(platformPriorityClass),
+		},
+		Value:       pulumi.Int(1000000),
+		Description: pulumi.String("Platform components that keep the cluster reconciled."),
+	}, pulumi.Provider(provider))
+}
+
+// platformReplicas run the platform components that tolerate more than one
+// replica, so one of them keeps serving while a node is drained.
+const platformReplicas = 2
+
+// newDisruptionBudgets creates a PodDisruptionBudget for each app of a platform
+// component, selecting its pods by the given label. Apps running more than one
+// replica keep at least one pod available. A single replica controller can't
+// stay available through a drain without blocking it, so its budget only limits
+// the evictions to one pod at a time, and the platform priority reschedules it
+// ahead of workloads.
+func newDisruptionBudgets(ctx *pulumi.Context, namespace pulumi.StringInput, labelKey string, apps []string, replicas int, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	for _, app := range apps {
+		spec := &policyv1.PodDisruptionBudgetSpecArgs{
+			Selector: &metav1.LabelSelectorArgs{
+				MatchLabels: pulumi.StringMap{
+					labelKey: pulumi.String(app),
+				},
+			},
+		}
+		if replicas > 1 {
+			spec.MinAvailable = pulumi.Int(1)
+		} else {
+			spec.MaxUnavailable = pulumi.Int(1)
+		}
+		_, err := policyv1.NewPodDisruptionBudget(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-pdb", app), &policyv1.PodDisruptionBudgetArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String(app),
+				Namespace: namespace,
+			},
+			Spec: spec,
+		}, append(opts, pulumi.Provider(provider))...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/route53"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	externalDNSNamespace      = "external-dns"
+	externalDNSServiceAccount = "external-dns"
+)
+
+// hostedZone is the Route53 zone that holds the DNS records of the cluster workloads.
+type hostedZone struct {
+	Name        string
+	ID          pulumi.StringOutput
+	Arn         pulumi.StringOutput
+	NameServers pulumi.StringArrayOutput
+}
+
+// newHostedZone creates the Route53 hosted zone, or adopts an existing one
+// when zoneID is set. An adopted zone is only looked up and never modified.
+func newHostedZone(ctx *pulumi.Context, name, zoneID string) (*hostedZone, error) {
+	if zoneID != "" {
+		existing, err := route53.LookupZone(ctx, &route53.LookupZoneArgs{
+			ZoneId: pulumi.StringRef(zoneID),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(existing.Name, ".") != strings.TrimSuffix(name, ".") {
+			return nil, fmt.Errorf("hosted zone %s is named %q, expected %q", zoneID, existing.Name, name)
+		}
+		return &hostedZone{
+			Name:        name,
+			ID:          pulumi.String(existing.ZoneId).ToStringOutput(),
+			Arn:         pulumi.String(existing.Arn).ToStringOutput(),
+			NameServers: pulumi.ToStringArray(existing.NameServers).ToStringArrayOutput(),
+		}, nil
+	}
+
+	zone, err := route53.NewZone(ctx, "pulumi-backstage-flux-gitops-aws-zone", &route53.ZoneArgs{
+		Name: pulumi.String(name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &hostedZone{
+		Name:        name,
+		ID:          zone.ZoneId,
+		Arn:         zone.Arn,
+		NameServers: zone.NameServers,
+	}, nil
+}
+
+// installExternalDNS deploys ExternalDNS with an IRSA role that may only change
+// records in the given zone. The TXT owner ID is the cluster name, so records
+// created by other clusters in the same zone are left alone.
+func installExternalDNS(ctx *pulumi.Context, cluster *eks.Cluster, zone *hostedZone, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (*helm.Release, error) {
+	role, err := newIRSARole(ctx, "external-dns-role", cluster, externalDNSNamespace, externalDNSServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("route53:ChangeResourceRecordSets"),
+				},
+				Resources: pulumi.StringArray{
+					zone.Arn,
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("route53:ListHostedZones"),
+					pulumi.String("route53:ListResourceRecordSets"),
+					pulumi.String("route53:ListTagsForResource"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.String("*"),
+				},
+			},
+		},
+	})
+
+	_, err = iam.NewRolePolicy(ctx, "external-dns-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ExternalDNS has no leader election, so it runs a single replica
+	externalDNS, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-external-dns", &helm.ReleaseArgs{
+		Chart:           pulumi.String("external-dns"),
+		Namespace:       pulumi.String(externalDNSNamespace),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("1.14.3"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://kubernetes-sigs.github.io/external-dns/"),
+		},
+		Values: pulumi.Map{
+			"provider": pulumi.Map{
+				"name": pulumi.String("aws"),
+			},
+			"policy":            pulumi.String("sync"),
+			"txtOwnerId":        cluster.EksCluster.Name(),
+			"priorityClassName": pulumi.String(platformPriorityClass),
+			"sources": pulumi.StringArray{
+				pulumi.String("service"),
+				pulumi.String("ingress"),
+			},
+			"domainFilters": pulumi.StringArray{
+				pulumi.String(zone.Name),
+			},
+			"extraArgs": pulumi.StringArray{
+				pulumi.Sprintf("--zone-id-filter=%s", zone.ID),
+			},
+			"env": pulumi.Array{
+				pulumi.Map{
+					"name":  pulumi.String("AWS_DEFAULT_REGION"),
+					"value": pulumi.String(region),
+				},
+			},
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(externalDNSServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = newDisruptionBudgets(ctx, externalDNS.Namespace.Elem(), "app.kubernetes.io/name", []string{"external-dns"}, 1, provider)
+	if err != nil {
+		return nil, err
+	}
+	return externalDNS, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// vpcEndpointConfig is read from the `vpcEndpoints` config key.
+type vpcEndpointConfig struct {
+	Enabled bool `json:"enabled"`
+	// Services get an interface endpoint each, like ecr.api or logs. S3 always
+	// gets a gateway endpoint.
+	Services []string `json:"services"`
+	// AwsBuckets are the buckets of other accounts the nodes read through the S3
+	// endpoint, with %s standing for the region.
+	AwsBuckets []string `json:"awsBuckets"`
+}
+
+func (c vpcEndpointConfig) withDefaults() vpcEndpointConfig {
+	if c.Services == nil {
+		// what nodes and Fargate pods need to pull images, ship logs and read secrets
+		c.Services = []string{
+			"ecr.api",
+			"ecr.dkr",
+			"logs",
+			"secretsmanager",
+			"ssm",
+			"sts",
+		}
+	}
+	if c.AwsBuckets == nil {
+		// the ECR image layers and the Amazon Linux package repositories, named in
+		// the ECR and Amazon Linux docs on gateway endpoint policies
+		c.AwsBuckets = []string{
+			"prod-%s-starport-layer-bucket",
+			"amazonlinux.%s.amazonaws.com",
+			"amazonlinux-2-repos-%s",
+			"al2023-repos-%s-de612dc2",
+		}
+	}
+	return c
+}
+
+// vpcEndpoints are the endpoints of the VPC. The S3 gateway endpoint is shared
+// with the programs that add route tables to the VPC.
+type vpcEndpoints struct {
+	s3        *ec2.VpcEndpoint
+	resources []pulumi.Resource
+}
+
+// newVpcEndpoints lets the private subnets reach the AWS APIs without a NAT
+// gateway. The interface endpoints only accept principals of our account, the
+// S3 endpoint only reaches our buckets and the AWS buckets nodes depend on.
+func newVpcEndpoints(ctx *pulumi.Context, cfg vpcEndpointConfig, network *vpcNetwork) (*vpcEndpoints, error) {
+	identity, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+		Statements: []iam.GetPolicyDocumentStatement{
+			{
+				Effect:    pulumi.StringRef("Allow"),
+				Actions:   []string{"*"},
+				Resources: []string{"*"},
+				Principals: []iam.GetPolicyDocumentStatementPrincipal{
+					{
+						Type:        "*",
+						Identifiers: []string{"*"},
+					},
+				},
+				Conditions: []iam.GetPolicyDocumentStatementCondition{
+					{
+						Test:     "StringEquals",
+						Variable: "aws:PrincipalAccount",
+						Values:   []string{identity.AccountId},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ECR serves the image layers through presigned URLs of an AWS bucket and the
+	// Amazon Linux repositories are read anonymously, so S3 is limited by the
+	// bucket owner instead of the caller
+	awsBucketObjects := make([]string, 0, len(cfg.AwsBuckets))
+	for _, bucket := range cfg.AwsBuckets {
+		if strings.Contains(bucket, "%s") {
+			bucket = fmt.Sprintf(bucket, region)
+		}
+		awsBucketObjects = append(awsBucketObjects, fmt.Sprintf("arn:aws:s3:::%s/*", bucket))
+	}
+	s3Policy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+		Statements: []iam.GetPolicyDocumentStatement{
+			{
+				Effect:    pulumi.StringRef("Allow"),
+				Actions:   []string{"*"},
+				Resources: []string{"*"},
+				Principals: []iam.GetPolicyDocumentStatementPrincipal{
+					{
+						Type:        "*",
+						Identifiers: []string{"*"},
+					},
+				},
+				Conditions: []iam.GetPolicyDocumentStatementCondition{
+					{
+						Test:     "StringEquals",
+						Variable: "aws:ResourceAccount",
+						Values:   []string{identity.AccountId},
+					},
+				},
+			},
+			{
+				Effect:    pulumi.StringRef("Allow"),
+				Actions:   []string{"s3:GetObject"},
+				Resources: awsBucketObjects,
+				Principals: []iam.GetPolicyDocumentStatementPrincipal{
+					{
+						Type:        "*",
+						Identifiers: []string{"*"},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s3Endpoint, err := ec2.NewVpcEndpoint(ctx, "pulumi-backstage-flux-gitops-aws-s3-endpoint", &ec2.VpcEndpointArgs{
+		VpcId:           network.vpcId,
+		ServiceName:     pulumi.Sprintf("com.amazonaws.%s.s3", region),
+		VpcEndpointType: pulumi.String("Gateway"),
+		RouteTableIds:   append(pulumi.StringArray{network.routeTableId}, network.privateRouteTableIds...),
+		Policy:          pulumi.String(s3Policy.Json),
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoints := &vpcEndpoints{
+		s3:        s3Endpoint,
+		resources: []pulumi.Resource{s3Endpoint},
+	}
+
+	subnetIDs := network.privateSubnetIDs
+	if len(subnetIDs) == 0 {
+		subnetIDs = network.publicSubnetIDs
+	}
+	for _, service := range cfg.Services {
+		name := strings.ReplaceAll(service, ".", "-")
+
+		securityGroup, err := ec2.NewSecurityGroup(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-endpoint-sg", name), &ec2.SecurityGroupArgs{
+			VpcId:       network.vpcId,
+			Description: pulumi.Sprintf("%s VPC endpoint", service),
+			Ingress: ec2.SecurityGroupIngressArray{
+				&ec2.SecurityGroupIngressArgs{
+					Protocol:    pulumi.String("tcp"),
+					FromPort:    pulumi.Int(443),
+					ToPort:      pulumi.Int(443),
+					CidrBlocks:  pulumi.StringArray{network.vpcCidr},
+					Description: pulumi.String("HTTPS from the VPC"),
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		endpoint, err := ec2.NewVpcEndpoint(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-endpoint", name), &ec2.VpcEndpointArgs{
+			VpcId:             network.vpcId,
+			ServiceName:       pulumi.Sprintf("com.amazonaws.%s.%s", region, service),
+			VpcEndpointType:   pulumi.String("Interface"),
+			PrivateDnsEnabled: pulumi.Bool(true),
+			SubnetIds:         subnetIDs,
+			SecurityGroupIds: pulumi.StringArray{
+				securityGroup.ID(),
+			},
+			Policy: pulumi.String(policy.Json),
+		})
+		if err != nil {
+			return nil, err
+		}
+		endpoints.resources = append(endpoints.resources, endpoint)
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/secretsmanager"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/apiextensions"
+	v1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/core/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	externalSecretsNamespace      = "external-secrets"
+	externalSecretsServiceAccount = "external-secrets"
+)
+
+// platformSecrets materialises the secrets the platform components read from
+// the cluster. Without a secret store they are written straight into the
+// cluster, otherwise they are written to Secrets Manager and synced by
+// External Secrets Operator, so they can be rotated without a `pulumi up`.
+type platformSecrets struct {
+	ctx      *pulumi.Context
+	provider pulumi.ProviderResource
+	store    *apiextensions.CustomResource
+}
+
+// installExternalSecrets deploys External Secrets Operator with an IRSA role
+// that can only read the secrets of this cluster, and a ClusterSecretStore
+// backed by Secrets Manager.
+func installExternalSecrets(ctx *pulumi.Context, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (*apiextensions.CustomResource, error) {
+	identity, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := newIRSARole(ctx, "external-secrets-role", cluster, externalSecretsNamespace, externalSecretsServiceAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+		Statements: []iam.GetPolicyDocumentStatement{
+			{
+				Effect: pulumi.StringRef("Allow"),
+				Actions: []string{
+					"secretsmanager:GetSecretValue",
+					"secretsmanager:DescribeSecret",
+					"secretsmanager:ListSecretVersionIds",
+				},
+				Resources: []string{
+					fmt.Sprintf("arn:aws:secretsmanager:%s:%s:secret:%s/*", region, identity.AccountId, clusterName),
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "external-secrets-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: pulumi.String(policy.Json),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	externalSecrets, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-external-secrets", &helm.ReleaseArgs{
+		Chart:           pulumi.String("external-secrets"),
+		Namespace:       pulumi.String(externalSecretsNamespace),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("0.9.13"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://charts.external-secrets.io"),
+		},
+		Values: pulumi.Map{
+			"installCRDs":       pulumi.Bool(true),
+			"replicaCount":      pulumi.Int(platformReplicas),
+			"leaderElect":       pulumi.Bool(true),
+			"priorityClassName": pulumi.String(platformPriorityClass),
+			"webhook": pulumi.Map{
+				"replicaCount":      pulumi.Int(platformReplicas),
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"certController": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(externalSecretsServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return nil, err
+	}
+
+	err = newDisruptionBudgets(ctx, externalSecrets.Namespace.Elem(), "app.kubernetes.io/name", []string{"external-secrets", "external-secrets-webhook"}, platformReplicas, provider)
+	if err != nil {
+		return nil, err
+	}
+	// the cert controller runs a single replica, it only renews the webhook certificate
+	err = newDisruptionBudgets(ctx, externalSecrets.Namespace.Elem(), "app.kubernetes.io/name", []string{"external-secrets-cert-controller"}, 1, provider)
+	if err != nil {
+		return nil, err
+	}
+
+	return apiextensions.NewCustomResource(ctx, "pulumi-backstage-flux-gitops-aws-secrets-manager-store", &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("external-secrets.io/v1beta1"),
+		Kind:       pulumi.String("ClusterSecretStore"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String("aws-secrets-manager"),
+		},
+		OtherFields: kubernetes.UntypedArgs{
+			"spec": pulumi.Map{
+				"provider": pulumi.Map{
+					"aws": pulumi.Map{
+						"service": pulumi.String("SecretsManager"),
+						"region":  pulumi.String(region),
+						"auth": pulumi.Map{
+							"jwt": pulumi.Map{
+								"serviceAccountRef": pulumi.Map{
+									"name":      pulumi.String(externalSecretsServiceAccount),
+									"namespace": pulumi.String(externalSecretsNamespace),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{externalSecrets}))
+}
+
+// newSecret creates the Kubernetes secret secretName in the namespace with the
+// given string data, which Pulumi keeps up to date. The resource name and an
+// empty secretType are kept for the plain Kubernetes secrets so existing stacks
+// don't replace them.
+func (p *platformSecrets) newSecret(name, secretName, secretType string, namespace pulumi.StringPtrInput, data pulumi.StringMap, opts ...pulumi.ResourceOption) error {
+	return p.create(name, secretName, secretType, false, namespace, data, opts...)
+}
+
+// newRotatedSecret is like newSecret for credentials operators rotate. With
+// External Secrets, the data only seeds the Secrets Manager value, so a rotated
+// value isn't overwritten by the next update.
+func (p *platformSecrets) newRotatedSecret(name, secretName, secretType string, namespace pulumi.StringPtrInput, data pulumi.StringMap, opts ...pulumi.ResourceOption) error {
+	return p.create(name, secretName, secretType, true, namespace, data, opts...)
+}
+
+func (p *platformSecrets) create(name, secretName, secretType string, rotated bool, namespace pulumi.StringPtrInput, data pulumi.StringMap, opts ...pulumi.ResourceOption) error {
+	opts = append(opts, pulumi.Provider(p.provider))
+	if p.store == nil {
+		args := &v1.SecretArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String(secretName),
+				Namespace: namespace,
+			},
+			StringData: data,
+		}
+		if secretType != "" {
+			args.Type = pulumi.String(secretType)
+		}
+		_, err := v1.NewSecret(p.ctx, name, args, opts...)
+		return err
+	}
+
+	secret, err := secretsmanager.NewSecret(p.ctx, name+"-sm-secret", &secretsmanager.SecretArgs{
+		Name: pulumi.String(fmt.Sprintf("%s/%s", clusterName, secretName)),
+	})
+	if err != nil {
+		return err
+	}
+	var versionOpts []pulumi.ResourceOption
+	if rotated {
+		versionOpts = append(versionOpts, pulumi.IgnoreChanges([]string{"secretString"}))
+	}
+	_, err = secretsmanager.NewSecretVersion(p.ctx, name+"-sm-secret-version", &secretsmanager.SecretVersionArgs{
+		SecretId:     secret.ID(),
+		SecretString: pulumi.ToSecret(pulumi.JSONMarshal(data)).(pulumi.StringOutput),
+	}, versionOpts...)
+	if err != nil {
+		return err
+	}
+
+	_, err = apiextensions.NewCustomResource(p.ctx, name+"-external-secret", &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("external-secrets.io/v1beta1"),
+		Kind:       pulumi.String("ExternalSecret"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name:      pulumi.String(secretName),
+			Namespace: namespace,
+		},
+		OtherFields: kubernetes.UntypedArgs{
+			"spec": pulumi.Map{
+				"refreshInterval": pulumi.String("1h"),
+				"secretStoreRef": pulumi.Map{
+					"kind": p.store.Kind,
+					"name": p.store.Metadata.Name(),
+				},
+				"target": pulumi.Map{
+					"name": pulumi.String(secretName),
+				},
+				"dataFrom": pulumi.Array{
+					pulumi.Map{
+						"extract": pulumi.Map{
+							"key": secret.Name,
+						},
+					},
+				},
+			},
+		},
+	}, append(opts, pulumi.DependsOn([]pulumi.Resource{p.store}))...)
+	return err
+}
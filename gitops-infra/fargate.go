@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	awseks "github.com/pulumi/pulumi-aws/sdk/v6/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// fargateConfig is read from the `fargate` config key.
+type fargateConfig struct {
+	Enabled bool `json:"enabled"`
+	// SubnetCidrs are the private subnets Fargate pods run in, one per availability zone.
+	SubnetCidrs []string                        `json:"subnetCidrs"`
+	Profiles    map[string]fargateProfileConfig `json:"profiles"`
+}
+
+// fargateProfileConfig selects the pods a Fargate profile schedules.
+type fargateProfileConfig struct {
+	Selectors []fargateSelector `json:"selectors"`
+}
+
+// fargateSelector matches pods by namespace and, optionally, labels.
+type fargateSelector struct {
+	Namespace string            `json:"namespace"`
+	Labels    map[string]string `json:"labels"`
+}
+
+func (c fargateConfig) withDefaults() fargateConfig {
+	if c.SubnetCidrs == nil {
+		c.SubnetCidrs = []string{
+			"10.0.0.192/27",
+			"10.0.0.224/27",
+		}
+	}
+	if c.Profiles == nil {
+		c.Profiles = map[string]fargateProfileConfig{
+			"platform": {
+				Selectors: []fargateSelector{
+					{Namespace: fluxNamespace},
+					{Namespace: operatorNamespace},
+					{Namespace: albNamespace},
+				},
+			},
+		}
+	}
+	return c
+}
+
+// platformNamespaces returns the platform namespaces a Fargate profile selects,
+// with or without labels.
+func (c fargateConfig) platformNamespaces() []string {
+	selected := map[string]bool{}
+	for _, profile := range c.Profiles {
+		for _, selector := range profile.Selectors {
+			selected[selector.Namespace] = true
+		}
+	}
+	var namespaces []string
+	for _, namespace := range []string{fluxNamespace, operatorNamespace, albNamespace} {
+		if selected[namespace] {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// runCoreDNSOnFargate adds a profile for CoreDNS and switches the managed add-on
+// to the Fargate compute type, as a cluster without node groups has nowhere
+// else to run it.
+func (c fargateConfig) runCoreDNSOnFargate(addons map[string]addonConfig) error {
+	coreDNS, ok := addons["coredns"]
+	if !ok {
+		return fmt.Errorf("a cluster without node groups needs the coredns add-on to run CoreDNS on Fargate")
+	}
+	if coreDNS.ConfigurationValues == nil {
+		coreDNS.ConfigurationValues = map[string]interface{}{}
+	}
+	coreDNS.ConfigurationValues["computeType"] = "Fargate"
+	addons["coredns"] = coreDNS
+
+	c.Profiles["coredns"] = fargateProfileConfig{
+		Selectors: []fargateSelector{
+			{
+				Namespace: "kube-system",
+				Labels: map[string]string{
+					"k8s-app": "kube-dns",
+				},
+			},
+		},
+	}
+	return nil
+}
+
+// newFargatePodExecutionRole creates the role the Fargate kubelet runs as. It
+// has to exist before the cluster, so it is mapped in aws-auth with the nodes.
+func newFargatePodExecutionRole(ctx *pulumi.Context) (*iam.Role, error) {
+	return iam.NewRole(ctx, "pulumi-backstage-flux-gitops-aws-fargate-pod-execution-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {
+					"Service": "eks-fargate-pods.amazonaws.com"
+				},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+		ManagedPolicyArns: pulumi.StringArray{
+			pulumi.String("arn:aws:iam::aws:policy/AmazonEKSFargatePodExecutionRolePolicy"),
+		},
+	})
+}
+
+// fargateRoleMapping maps the pod execution role like the EKS console does.
+func fargateRoleMapping(role *iam.Role) eks.RoleMappingArgs {
+	return eks.RoleMappingArgs{
+		RoleArn:  role.Arn,
+		Username: pulumi.String("system:node:{{SessionName}}"),
+		Groups: pulumi.StringArray{
+			pulumi.String("system:bootstrappers"),
+			pulumi.String("system:nodes"),
+			pulumi.String("system:node-proxier"),
+		},
+	}
+}
+
+// newFargateSubnets adds the private subnets for Fargate pods to the network.
+// With the nat egress they reach the internet through a NAT gateway in the
+// first public subnet, with the endpoints egress only the VPC endpoints.
+func newFargateSubnets(ctx *pulumi.Context, cfg fargateConfig, network *vpcNetwork, egress string) error {
+	if len(cfg.SubnetCidrs) != len(availabilityZones) {
+		return fmt.Errorf("fargate needs one subnet per availability zone, got %d subnets for %d zones", len(cfg.SubnetCidrs), len(availabilityZones))
+	}
+
+	var routes ec2.RouteTableRouteArray
+	if egress == egressNat {
+		eip, err := ec2.NewEip(ctx, "pulumi-backstage-flux-gitops-aws-nat-eip", &ec2.EipArgs{
+			Domain: pulumi.String("vpc"),
+		})
+		if err != nil {
+			return err
+		}
+
+		nat, err := ec2.NewNatGateway(ctx, "pulumi-backstage-flux-gitops-aws-nat", &ec2.NatGatewayArgs{
+			AllocationId: eip.ID(),
+			SubnetId:     network.publicSubnetIDs[0],
+		})
+		if err != nil {
+			return err
+		}
+		routes = ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock:    pulumi.String("0.0.0.0/0"),
+				NatGatewayId: nat.ID(),
+			},
+		}
+	}
+
+	rt, err := ec2.NewRouteTable(ctx, "pulumi-backstage-flux-gitops-aws-private-rt", &ec2.RouteTableArgs{
+		VpcId:  network.vpcId,
+		Routes: routes,
+	})
+	if err != nil {
+		return err
+	}
+
+	var subnetIDs pulumi.StringArray
+	for i, az := range availabilityZones {
+		subnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-fargate-subnet-%d", i), &ec2.SubnetArgs{
+			VpcId:            network.vpcId,
+			CidrBlock:        pulumi.String(cfg.SubnetCidrs[i]),
+			AvailabilityZone: pulumi.String(az),
+			Tags: pulumi.StringMap{
+				"Name":                                 pulumi.Sprintf("pulumi-backstage-flux-gitops-aws-fargate-subnet-%s", az),
+				"kubernetes.io/role/internal-elb":      pulumi.String("1"),
+				"kubernetes.io/cluster/" + clusterName: pulumi.String("shared"),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-private-rt-association-%s", az), &ec2.RouteTableAssociationArgs{
+			RouteTableId: rt.ID(),
+			SubnetId:     subnet.ID(),
+		})
+		if err != nil {
+			return err
+		}
+		subnetIDs = append(subnetIDs, subnet.ID())
+	}
+	network.privateSubnetIDs = subnetIDs
+	network.privateRouteTableIds = pulumi.StringArray{rt.ID()}
+	network.usedSubnetCidrs = append(network.usedSubnetCidrs, cfg.SubnetCidrs...)
+	return nil
+}
+
+// newFargateProfiles creates the configured profiles. EKS creates one profile
+// of a cluster at a time, so each profile waits for the previous one.
+func newFargateProfiles(ctx *pulumi.Context, cfg fargateConfig, cluster *eks.Cluster, role *iam.Role, subnetIDs pulumi.StringArray) ([]pulumi.Resource, error) {
+	names := make([]string, 0, len(cfg.Profiles))
+	for name := range cfg.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var profiles []pulumi.Resource
+	for _, name := range names {
+		var selectors awseks.FargateProfileSelectorArray
+		for _, selector := range cfg.Profiles[name].Selectors {
+			selectors = append(selectors, &awseks.FargateProfileSelectorArgs{
+				Namespace: pulumi.String(selector.Namespace),
+				Labels:    pulumi.ToStringMap(selector.Labels),
+			})
+		}
+		profile, err := awseks.NewFargateProfile(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-fargate-profile", name), &awseks.FargateProfileArgs{
+			ClusterName:         cluster.EksCluster.Name(),
+			FargateProfileName:  pulumi.String(name),
+			PodExecutionRoleArn: role.Arn,
+			SubnetIds:           subnetIDs,
+			Selectors:           selectors,
+		}, pulumi.DependsOn(profiles))
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// newIRSARole creates an IAM role that can only be assumed by the given
+// Kubernetes service account through the cluster's OIDC provider.
+func newIRSARole(ctx *pulumi.Context, name string, cluster *eks.Cluster, namespace, serviceAccount string, opts ...pulumi.ResourceOption) (*iam.Role, error) {
+	subject := fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccount)
+	return iam.NewRole(ctx, name, &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.All(cluster.Core.OidcProvider().Arn(), cluster.Core.OidcProvider().Url()).ApplyT(func(args []interface{}) string {
+			arn := args[0].(string)
+			url := args[1].(string)
+			assumeRolePolicy, _ := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+				Statements: []iam.GetPolicyDocumentStatement{
+					{
+						Effect: pulumi.StringRef("Allow"),
+						Actions: []string{
+							"sts:AssumeRoleWithWebIdentity",
+						},
+						Principals: []iam.GetPolicyDocumentStatementPrincipal{
+							{
+								Type: "Federated",
+								Identifiers: []string{
+									arn,
+								},
+							},
+						},
+						Conditions: []iam.GetPolicyDocumentStatementCondition{
+							{
+								Test: "StringEquals",
+								Values: []string{
+									subject,
+								},
+								Variable: fmt.Sprintf("%s:sub", url),
+							},
+						},
+					},
+				},
+			})
+			return assumeRolePolicy.Json
+		}).(pulumi.StringOutput),
+	}, opts...)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	b64 "encoding/base64"
 	"fmt"
-	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
 	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
 	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
@@ -14,7 +13,7 @@ import (
 	rbac "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/rbac/v1"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
-	"os"
+	"strings"
 )
 
 var (
@@ -30,137 +29,226 @@ var (
 
 const (
 	clusterName       = "pulumi-backstage-flux-gitops-aws"
+	region            = "eu-central-1"
 	albNamespace      = "aws-lb-controller"
-	albServiceAccount = "system:serviceaccount:" + albNamespace + ":aws-lb-controller-serviceaccount"
+	albServiceAccount = "aws-lb-controller-serviceaccount"
+	albAddon          = "aws-load-balancer-controller"
+	fluxNamespace     = "flux-system"
+	operatorNamespace = "pulumi-operator"
 )
 
 func main() {
 	pulumi.Run(func(ctx *pulumi.Context) error {
 
-		vpc, err := ec2.NewVpc(ctx, "pulumi-backstage-flux-gitops-aws-vpc", &ec2.VpcArgs{
-			CidrBlock: pulumi.String("10.0.0.0/24"),
-		})
+		// resolve the IAM policy before creating anything, so an unsupported controller version fails fast
+		albControllerVersion := config.Get(ctx, "albControllerVersion")
+		albPolicy, err := iamPolicy(albAddon, albControllerVersion)
 		if err != nil {
 			return err
 		}
-		ctx.Export("vpc-id", vpc.ID())
 
-		igw, err := ec2.NewInternetGateway(ctx, "pulumi-backstage-flux-gitops-aws-igw", &ec2.InternetGatewayArgs{
-			VpcId: vpc.ID(),
-		})
-		if err != nil {
+		eksVersion := config.Get(ctx, "eksVersion")
+
+		// pin the EKS managed add-ons instead of relying on the EKS defaults
+		var addons map[string]addonConfig
+		if err := config.GetObject(ctx, "eksAddons", &addons); err != nil {
 			return err
 		}
+		if addons == nil {
+			addons = defaultAddons()
+		}
+		var networkPolicyCfg networkPolicyConfig
+		if err := config.GetObject(ctx, "networkPolicy", &networkPolicyCfg); err != nil {
+			return err
+		}
+		networkPolicyCfg = networkPolicyCfg.withDefaults()
+		if networkPolicyCfg.Enabled {
+			switch networkPolicyCfg.Engine {
+			case "vpc-cni":
+				if err := enableVpcCniNetworkPolicy(addons); err != nil {
+					return err
+				}
+			case "calico":
+			default:
+				return fmt.Errorf("unsupported network policy engine %q, use vpc-cni or calico", networkPolicyCfg.Engine)
+			}
+		}
+		_, managedVpcCni := addons["vpc-cni"]
 
-		rt, err := ec2.NewRouteTable(ctx, "pulumi-backstage-flux-gitops-aws-rt", &ec2.RouteTableArgs{
-			VpcId: vpc.ID(),
-			Routes: ec2.RouteTableRouteArray{
-				&ec2.RouteTableRouteArgs{
-					CidrBlock: pulumi.String("0.0.0.0/0"),
-					GatewayId: igw.ID(),
-				},
-			},
-		})
+		if err := checkEKSUpgrade(ctx, eksVersion, config.GetBool(ctx, "eksUpgrade"), addons); err != nil {
+			return err
+		}
+
+		// run the platform namespaces on Fargate, away from the workload nodes
+		var fargateCfg fargateConfig
+		if err := config.GetObject(ctx, "fargate", &fargateCfg); err != nil {
+			return err
+		}
+		if fargateCfg.Enabled {
+			fargateCfg = fargateCfg.withDefaults()
+		}
+
+		var existingVpcCfg existingVpcConfig
+		if err := config.GetObject(ctx, "existingVpc", &existingVpcCfg); err != nil {
+			return err
+		}
+		var network *vpcNetwork
+		if existingVpcCfg.enabled() {
+			// Fargate needs private subnets, we don't add any to a VPC we don't own
+			tiers := []string{"public"}
+			if fargateCfg.Enabled {
+				tiers = append(tiers, "private")
+			}
+			network, err = lookupVpcNetwork(ctx, existingVpcCfg, tiers)
+		} else {
+			network, err = newVpcNetwork(ctx)
+		}
 		if err != nil {
 			return err
 		}
-		ctx.Export("route-table-id", rt.ID())
+		publicSubnetIDs := network.publicSubnetIDs
+		ctx.Export("vpc-id", network.vpcId)
+		ctx.Export("vpc-cidr", network.vpcCidr)
+		ctx.Export("route-table-id", network.routeTableId)
+		ctx.Export("public-subnet-ids", publicSubnetIDs)
 
-		var publicSubnetIDs pulumi.StringArray
+		// reach the AWS APIs from the private subnets without going through NAT
+		var vpcEndpointCfg vpcEndpointConfig
+		if err := config.GetObject(ctx, "vpcEndpoints", &vpcEndpointCfg); err != nil {
+			return err
+		}
+		privateEgress := config.Get(ctx, "privateEgress")
+		switch privateEgress {
+		case "", egressNat:
+			privateEgress = egressNat
+		case egressEndpoints:
+			if !vpcEndpointCfg.Enabled {
+				return fmt.Errorf("the endpoints private egress needs vpcEndpoints to be enabled")
+			}
+			// the platform controllers pull from ghcr.io, quay.io and public.ecr.aws and
+			// Flux clones from GitHub, none of them is reachable through a VPC endpoint
+			if namespaces := fargateCfg.platformNamespaces(); fargateCfg.Enabled && len(namespaces) > 0 {
+				return fmt.Errorf("the endpoints private egress can't serve the Fargate namespaces %s, they need public registries and GitHub; use the nat private egress or keep them off Fargate",
+					strings.Join(namespaces, ", "))
+			}
+		default:
+			return fmt.Errorf("unsupported private egress %q, use nat or endpoints", privateEgress)
+		}
 
-		// Create a subnet for each availability zone
-		for i, az := range availabilityZones {
-			publicSubnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-subnet-%d", i), &ec2.SubnetArgs{
-				VpcId:                       vpc.ID(),
-				CidrBlock:                   pulumi.String(publicSubnetCidrs[i]),
-				MapPublicIpOnLaunch:         pulumi.Bool(false),
-				AssignIpv6AddressOnCreation: pulumi.Bool(false),
-				AvailabilityZone:            pulumi.String(az),
-				Tags: pulumi.StringMap{
-					"Name": pulumi.Sprintf("pulumi-backstage-flux-gitops-aws-subnet-%d", az),
-				},
-			})
+		if fargateCfg.Enabled && !existingVpcCfg.enabled() {
+			if err := newFargateSubnets(ctx, fargateCfg, network, privateEgress); err != nil {
+				return err
+			}
+		}
+		ctx.Export("private-route-table-ids", network.privateRouteTableIds)
+
+		var endpointResources []pulumi.Resource
+		if vpcEndpointCfg.Enabled {
+			endpoints, err := newVpcEndpoints(ctx, vpcEndpointCfg.withDefaults(), network)
 			if err != nil {
 				return err
 			}
-			_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-rt-association-%s", az), &ec2.RouteTableAssociationArgs{
-				RouteTableId: rt.ID(),
-				SubnetId:     publicSubnet.ID(),
-			})
+			endpointResources = endpoints.resources
+			// the programs sharing the VPC add their route tables to the S3 endpoint
+			ctx.Export("s3-endpoint-id", endpoints.s3.ID())
+		}
+
+		var controlPlaneCfg controlPlaneConfig
+		if err := config.GetObject(ctx, "controlPlane", &controlPlaneCfg); err != nil {
+			return err
+		}
+		controlPlaneCfg = controlPlaneCfg.withDefaults()
+		if err := controlPlaneCfg.validate(); err != nil {
+			return err
+		}
+		if controlPlaneCfg.worldOpen() {
+			if err := ctx.Log.Warn("controlPlane.publicAccessCidrs opens the Kubernetes API endpoint to the internet", nil); err != nil {
+				return err
+			}
+		}
+		clusterLogGroup, secretsKeyArn, err := newControlPlaneResources(ctx, controlPlaneCfg)
+		if err != nil {
+			return err
+		}
+
+		var nodeCfg nodeConfig
+		if err := config.GetObject(ctx, "nodes", &nodeCfg); err != nil {
+			return err
+		}
+		nodeCfg = nodeCfg.withDefaults()
+		nodeRole, err := newNodeRole(ctx)
+		if err != nil {
+			return err
+		}
+
+		var roleMappings eks.RoleMappingArray
+		var fargateRole *iam.Role
+		if fargateCfg.Enabled {
+			if len(nodeCfg.Groups) == 0 {
+				if err := fargateCfg.runCoreDNSOnFargate(addons); err != nil {
+					return err
+				}
+			}
+			fargateRole, err = newFargatePodExecutionRole(ctx)
 			if err != nil {
 				return err
 			}
-			publicSubnetIDs = append(publicSubnetIDs, publicSubnet.ID())
+			roleMappings = append(roleMappings, fargateRoleMapping(fargateRole))
+		} else if len(nodeCfg.Groups) == 0 {
+			return fmt.Errorf("a cluster without node groups needs fargate to be enabled")
 		}
-		ctx.Export("public-subnet-ids", publicSubnetIDs)
 
 		cluster, err := eks.NewCluster(ctx, clusterName, &eks.ClusterArgs{
-			Name:                 pulumi.String(clusterName),
-			VpcId:                vpc.ID(),
-			PrivateSubnetIds:     publicSubnetIDs,
-			EndpointPublicAccess: pulumi.Bool(true),
-			InstanceType:         pulumi.String("t3.medium"),
-			DesiredCapacity:      pulumi.Int(2),
-			MinSize:              pulumi.Int(1),
-			MaxSize:              pulumi.Int(3),
+			Name:                   pulumi.String(clusterName),
+			VpcId:                  network.vpcId,
+			PrivateSubnetIds:       publicSubnetIDs,
+			EndpointPrivateAccess:  pulumi.Bool(true),
+			EndpointPublicAccess:   pulumi.Bool(!controlPlaneCfg.PrivateOnly),
+			PublicAccessCidrs:      pulumi.ToStringArray(controlPlaneCfg.PublicAccessCidrs),
+			EnabledClusterLogTypes: pulumi.ToStringArray(controlPlaneCfg.LogTypes),
+			EncryptionConfigKeyArn: secretsKeyArn,
+			SkipDefaultNodeGroup:   pulumi.BoolRef(true),
+			InstanceRoles: iam.RoleArray{
+				nodeRole,
+			},
+			RoleMappings: roleMappings,
 			ProviderCredentialOpts: eks.KubeconfigOptionsArgs{
 				ProfileName: pulumi.String("default"),
 			},
-			Version:            pulumi.String(config.Get(ctx, "eksVersion")),
+			Version:            pulumi.String(eksVersion),
 			CreateOidcProvider: pulumi.Bool(true),
-		})
+			UseDefaultVpcCni:   &managedVpcCni,
+		}, pulumi.DependsOn(append([]pulumi.Resource{clusterLogGroup}, endpointResources...)))
 		if err != nil {
 			return err
 		}
 
 		ctx.Export("kubeconfig", pulumi.ToSecret(cluster.Kubeconfig))
 
-		// enable ALB
-		albRole, err := iam.NewRole(ctx, "alb-role", &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.All(cluster.Core.OidcProvider().Arn(), cluster.Core.OidcProvider().Url()).ApplyT(func(args []interface{}) string {
-				arn := args[0].(string)
-				url := args[1].(string)
-				assumeRolePolicy, _ := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
-					Statements: []iam.GetPolicyDocumentStatement{
-						{
-							Effect: pulumi.StringRef("Allow"),
-							Actions: []string{
-								"sts:AssumeRoleWithWebIdentity",
-							},
-							Principals: []iam.GetPolicyDocumentStatementPrincipal{
-								{
-									Type: "Federated",
-									Identifiers: []string{
-										arn,
-									},
-								},
-							},
-							Conditions: []iam.GetPolicyDocumentStatementCondition{
-								{
-									Test: "StringEquals",
-									Values: []string{
-										albServiceAccount,
-									},
-									Variable: fmt.Sprintf("%s:sub", url),
-								},
-							},
-						},
-					},
-				})
-				return assumeRolePolicy.Json
-			}).(pulumi.StringOutput),
-		})
+		nodeGroups, err := newNodeGroups(ctx, nodeCfg, cluster, nodeRole, publicSubnetIDs)
 		if err != nil {
 			return err
 		}
 
-		albPolicyFile, err := os.ReadFile("./iam-policies/alb-iam-policy.json")
+		var fargateProfiles []pulumi.Resource
+		if fargateCfg.Enabled {
+			fargateProfiles, err = newFargateProfiles(ctx, fargateCfg, cluster, fargateRole, network.privateSubnetIDs)
+			if err != nil {
+				return err
+			}
+		}
+
+		// let the programs sharing the VPC allocate their subnets around ours
+		ctx.Export("used-subnet-cidrs", pulumi.ToStringArray(network.usedSubnetCidrs))
+
+		// enable ALB
+		albRole, err := newIRSARole(ctx, "alb-role", cluster, albNamespace, albServiceAccount)
 		if err != nil {
 			return err
 		}
 
 		albIAMPolicy, err := iam.NewPolicy(ctx, "alb-policy", &iam.PolicyArgs{
-			Policy: pulumi.String(albPolicyFile),
+			Policy: pulumi.String(albPolicy),
 		}, pulumi.DependsOn([]pulumi.Resource{albRole}))
 		if err != nil {
 			return err
@@ -182,79 +270,249 @@ func main() {
 			return err
 		}
 
+		_, err = installAddons(ctx, addons, eksVersion, cluster, k8sProvider, pulumi.DependsOn(fargateProfiles))
+		if err != nil {
+			return err
+		}
+
+		// platform components are scheduled with priority and wait for the node groups
+		priorityClass, err := newPlatformPriorityClass(ctx, k8sProvider)
+		if err != nil {
+			return err
+		}
+		platformDependencies := append([]pulumi.Resource{priorityClass}, nodeGroups...)
+		platformDependencies = append(platformDependencies, fargateProfiles...)
+
+		// drain nodes gracefully on spot interruptions and instance events
+		if config.GetBool(ctx, "nodeTerminationHandler") {
+			err = installNodeTerminationHandler(ctx, cluster, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+		}
+
 		backStageLabel := pulumi.StringMap{
 			"backstage.io/kubernetes-id": pulumi.String("gitops-cluster"),
 		}
 
+		var podSecurityCfg podSecurityConfig
+		if err := config.GetObject(ctx, "podSecurity", &podSecurityCfg); err != nil {
+			return err
+		}
+		podSecurityCfg = podSecurityCfg.withDefaults()
+
+		fluxNS, err := v1.NewNamespace(ctx, "pulumi-backstage-flux-gitops-aws-flux-system-ns", &v1.NamespaceArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:   pulumi.String(fluxNamespace),
+				Labels: podSecurityCfg.namespaceLabels(fluxNamespace),
+			},
+		}, pulumi.Provider(k8sProvider))
+		if err != nil {
+			return err
+		}
+
 		flux, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-flux2", &helm.ReleaseArgs{
-			Chart:           pulumi.String("oci://ghcr.io/fluxcd-community/charts/flux2"),
-			Namespace:       pulumi.String("flux-system"),
-			CreateNamespace: pulumi.Bool(true),
-			Version:         pulumi.String("2.12.2"),
+			Chart:     pulumi.String("oci://ghcr.io/fluxcd-community/charts/flux2"),
+			Namespace: fluxNS.Metadata.Name().Elem(),
+			Version:   pulumi.String(fluxChartVersion),
 			Values: pulumi.Map{
 				"helmController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 				"kustomizeController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 				"notificationController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 				"sourceController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 				"imageReflectionController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 				"imageAutomationController": pulumi.Map{
-					"labels": backStageLabel,
+					"labels":            backStageLabel,
+					"priorityClassName": pulumi.String(platformPriorityClass),
 				},
 			},
-		}, pulumi.Provider(k8sProvider))
+		}, pulumi.Provider(k8sProvider), pulumi.DependsOn(platformDependencies))
 		if err != nil {
 			return err
 		}
 
-		_, err = v1.NewSecret(ctx, "aws-lb-controller-secret", &v1.SecretArgs{
-			Metadata: &metav1.ObjectMetaArgs{
-				Name:      pulumi.String("aws-load-balancer-controller-values"),
-				Namespace: flux.Namespace,
-			},
-			StringData: pulumi.StringMap{
-				"values.yaml": pulumi.Sprintf(`clusterName: %s
-region: eu-central-1
+		// source-controller serves the artifacts from its own disk and the other
+		// controllers elect a single leader, so they run one replica each
+		err = newDisruptionBudgets(ctx, flux.Namespace.Elem(), "app", fluxControllers, 1, k8sProvider)
+		if err != nil {
+			return err
+		}
+
+		// materialise the platform secrets through External Secrets Operator when enabled
+		secrets := &platformSecrets{ctx: ctx, provider: k8sProvider}
+		if config.GetBool(ctx, "externalSecrets") {
+			secrets.store, err = installExternalSecrets(ctx, cluster, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = secrets.newSecret("aws-lb-controller-secret", "aws-load-balancer-controller-values", "", flux.Namespace, pulumi.StringMap{
+			"values.yaml": pulumi.Sprintf(`clusterName: %s
+region: %s
+image:
+  tag: %s
 serviceAccount:
   annotations:
     eks.amazonaws.com/role-arn: %s
-vpcId: %s`, cluster.EksCluster.Name(), albRole.Arn, vpc.ID()),
-			},
-		}, pulumi.Provider(k8sProvider))
+vpcId: %s`, cluster.EksCluster.Name(), region, albControllerVersion, albRole.Arn, network.vpcId),
+		})
 		if err != nil {
 			return err
 		}
 
+		// manage DNS records of the cluster workloads with ExternalDNS
+		var zone *hostedZone
+		if dnsZoneName := config.Get(ctx, "dnsZone"); dnsZoneName != "" {
+			zone, err = newHostedZone(ctx, dnsZoneName, config.Get(ctx, "dnsZoneId"))
+			if err != nil {
+				return err
+			}
+			ctx.Export("dns-zone-id", zone.ID)
+			ctx.Export("dns-zone-name", pulumi.String(zone.Name))
+			ctx.Export("dns-zone-name-servers", zone.NameServers)
+
+			_, err = installExternalDNS(ctx, cluster, zone, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+		}
+
+		// issue TLS certificates for the cluster workloads with cert-manager
+		var certManagerCfg certManagerConfig
+		if err := config.GetObject(ctx, "certManager", &certManagerCfg); err != nil {
+			return err
+		}
+		if certManagerCfg.Enabled {
+			issuers, err := installCertManager(ctx, certManagerCfg, cluster, zone, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+			ctx.Export("cluster-issuers", issuers)
+		}
+
+		// back up the cluster state and volumes with Velero
+		var veleroCfg veleroConfig
+		if err := config.GetObject(ctx, "velero", &veleroCfg); err != nil {
+			return err
+		}
+		if veleroCfg.Enabled {
+			backupBucket, err := installVelero(ctx, veleroCfg.withDefaults(), cluster, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+			ctx.Export("velero-bucket", backupBucket)
+		}
+
+		// collect metrics of the cluster and Flux
+		var monitoringCfg monitoringConfig
+		if err := config.GetObject(ctx, "monitoring", &monitoringCfg); err != nil {
+			return err
+		}
+		if err := monitoringCfg.validate(); err != nil {
+			return err
+		}
+		if monitoringCfg.Enabled {
+			grafanaPassword, err := installMonitoring(ctx, monitoringCfg, cluster, k8sProvider, pulumi.DependsOn(append([]pulumi.Resource{flux}, platformDependencies...)))
+			if err != nil {
+				return err
+			}
+			ctx.Export("grafana-admin-password", pulumi.ToSecret(grafanaPassword))
+		}
+
+		// allocate the cluster costs to namespaces and Backstage components with OpenCost
+		var openCostCfg openCostConfig
+		if err := config.GetObject(ctx, "openCost", &openCostCfg); err != nil {
+			return err
+		}
+		if openCostCfg.Enabled {
+			if !monitoringCfg.Enabled {
+				return fmt.Errorf("openCost reads the cluster metrics from Prometheus and requires monitoring to be enabled")
+			}
+			allocationPath, err := installOpenCost(ctx, openCostCfg.withDefaults(), cluster, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+			ctx.Export("opencost-allocation-path", pulumi.String(allocationPath))
+		}
+
 		// create namespace for the Pulumi Operator
 		operatorNS, err := v1.NewNamespace(ctx, "pulumi-backstage-flux-gitops-aws-pulumi-operator-ns", &v1.NamespaceArgs{
 			Metadata: &metav1.ObjectMetaArgs{
-				Name: pulumi.String("pulumi-operator"),
+				Name:   pulumi.String(operatorNamespace),
+				Labels: podSecurityCfg.namespaceLabels(operatorNamespace),
 			},
 		}, pulumi.Provider(k8sProvider))
 		if err != nil {
 			return err
 		}
 
-		// add secret with Pulumi access token
-		_, err = v1.NewSecret(ctx, "pulumi-backstage-flux-gitops-aws-pulumi-access-token", &v1.SecretArgs{
+		// create namespace for the AWS Load Balancer Controller, so its Pod Security labels apply from the start
+		albNS, err := v1.NewNamespace(ctx, "pulumi-backstage-flux-gitops-aws-aws-lb-controller-ns", &v1.NamespaceArgs{
 			Metadata: &metav1.ObjectMetaArgs{
-				Name:      pulumi.String("pulumi-access-token"),
-				Namespace: operatorNS.Metadata.Name(),
-			},
-			Type: pulumi.String("Opaque"),
-			StringData: pulumi.StringMap{
-				"pulumi-access-token": config.GetSecret(ctx, "pulumi-pat"),
+				Name:   pulumi.String(albNamespace),
+				Labels: podSecurityCfg.namespaceLabels(albNamespace),
 			},
-		}, pulumi.Provider(k8sProvider), pulumi.DependsOn([]pulumi.Resource{operatorNS}))
+		}, pulumi.Provider(k8sProvider))
+		if err != nil {
+			return err
+		}
+
+		// restrict the traffic of the platform namespaces
+		if networkPolicyCfg.Enabled {
+			if fargateCfg.Enabled {
+				// neither the VPC CNI nor Calico enforce network policies for Fargate pods
+				for _, namespace := range fargateCfg.platformNamespaces() {
+					err := ctx.Log.Warn(fmt.Sprintf("the network policies of namespace %s are not enforced, its pods run on Fargate", namespace), nil)
+					if err != nil {
+						return err
+					}
+				}
+			}
+			policyDependencies := []pulumi.Resource{flux, operatorNS, albNS}
+			if networkPolicyCfg.Engine == "calico" {
+				calico, err := installCalico(ctx, k8sProvider, pulumi.DependsOn(platformDependencies))
+				if err != nil {
+					return err
+				}
+				policyDependencies = append(policyDependencies, calico)
+			}
+			err = newPlatformNetworkPolicies(ctx, network.vpcCidr, k8sProvider, pulumi.DependsOn(policyDependencies))
+			if err != nil {
+				return err
+			}
+		}
+
+		// admission policies on top of the Pod Security levels
+		if podSecurityCfg.PolicyEngine != "" {
+			err = installPolicyEngine(ctx, podSecurityCfg, k8sProvider, pulumi.DependsOn(platformDependencies))
+			if err != nil {
+				return err
+			}
+		}
+
+		// add secret with Pulumi access token
+		err = secrets.newRotatedSecret("pulumi-backstage-flux-gitops-aws-pulumi-access-token", "pulumi-access-token", "Opaque", operatorNS.Metadata.Name(), pulumi.StringMap{
+			"pulumi-access-token": config.GetSecret(ctx, "pulumi-pat"),
+		}, pulumi.DependsOn([]pulumi.Resource{operatorNS}))
+		if err != nil {
+			return err
+		}
 
 		// deploy boostrap repository Kustomization
 		boostrapRepo, err := apiextensions.NewCustomResource(ctx, "pulumi-backstage-flux-gitops-aws-bootstrap-repo", &apiextensions.CustomResourceArgs{
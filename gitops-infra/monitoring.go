@@ -0,0 +1,381 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/amp"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/apiextensions"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi-random/sdk/v4/go/random"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	monitoringNamespace      = "monitoring"
+	prometheusServiceAccount = "prometheus"
+	fluxDashboardsURL        = "https://raw.githubusercontent.com/fluxcd/flux2-monitoring-example/%s/monitoring/configs/dashboards"
+)
+
+// commitPattern matches a full git commit hash. Tags and branches can move.
+var commitPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// fluxDashboards holds the Grafana dashboards of Flux, laid out as
+// dashboards/flux/<dashboard>.json. They query the gotk_resource_info state
+// metrics and the controller metrics of the Flux release of fluxChartVersion,
+// so they are reviewed together with the chart.
+//
+//go:embed dashboards/flux
+var fluxDashboards embed.FS
+
+// fluxControllers are the controllers deployed by the flux2 chart.
+var fluxControllers = []string{
+	"helm-controller",
+	"kustomize-controller",
+	"notification-controller",
+	"source-controller",
+	"image-reflector-controller",
+	"image-automation-controller",
+}
+
+// fluxKinds are the Flux custom resources kube-state-metrics reports as gotk_resource_info.
+var fluxKinds = []struct {
+	group, version, kind, resource string
+}{
+	{"source.toolkit.fluxcd.io", "v1", "GitRepository", "gitrepositories"},
+	{"source.toolkit.fluxcd.io", "v1beta2", "Bucket", "buckets"},
+	{"source.toolkit.fluxcd.io", "v1beta2", "HelmRepository", "helmrepositories"},
+	{"source.toolkit.fluxcd.io", "v1beta2", "HelmChart", "helmcharts"},
+	{"source.toolkit.fluxcd.io", "v1beta2", "OCIRepository", "ocirepositories"},
+	{"kustomize.toolkit.fluxcd.io", "v1", "Kustomization", "kustomizations"},
+	{"helm.toolkit.fluxcd.io", "v2beta2", "HelmRelease", "helmreleases"},
+	{"image.toolkit.fluxcd.io", "v1beta2", "ImageRepository", "imagerepositories"},
+	{"image.toolkit.fluxcd.io", "v1beta2", "ImagePolicy", "imagepolicies"},
+	{"image.toolkit.fluxcd.io", "v1beta1", "ImageUpdateAutomation", "imageupdateautomations"},
+}
+
+// monitoringConfig is read from the `monitoring` config key.
+type monitoringConfig struct {
+	Enabled bool `json:"enabled"`
+	// AmazonManagedPrometheus remote-writes all metrics into an Amazon Managed Prometheus workspace.
+	AmazonManagedPrometheus bool `json:"amazonManagedPrometheus"`
+	// FluxDashboardsRef loads the Grafana dashboards from a commit of
+	// fluxcd/flux2-monitoring-example instead of the embedded fluxDashboards. It
+	// must match the Flux release of fluxChartVersion.
+	FluxDashboardsRef string `json:"fluxDashboardsRef"`
+}
+
+func (c monitoringConfig) validate() error {
+	if c.FluxDashboardsRef != "" && !commitPattern.MatchString(c.FluxDashboardsRef) {
+		return fmt.Errorf("monitoring.fluxDashboardsRef must be a commit of fluxcd/flux2-monitoring-example, got %q", c.FluxDashboardsRef)
+	}
+	return nil
+}
+
+// fluxStateMetrics renders the kube-state-metrics custom resource state
+// config and RBAC rules, so the Flux objects are reported with their ready and
+// suspended state.
+func fluxStateMetrics() (pulumi.Map, pulumi.Array) {
+	var resources pulumi.Array
+	rules := map[string]pulumi.StringArray{}
+	var groups []string
+	for _, kind := range fluxKinds {
+		resources = append(resources, pulumi.Map{
+			"groupVersionKind": pulumi.Map{
+				"group":   pulumi.String(kind.group),
+				"version": pulumi.String(kind.version),
+				"kind":    pulumi.String(kind.kind),
+			},
+			"metricNamePrefix": pulumi.String("gotk"),
+			"metrics": pulumi.Array{
+				pulumi.Map{
+					"name": pulumi.String("resource_info"),
+					"help": pulumi.Sprintf("The current state of a Flux %s resource.", kind.kind),
+					"each": pulumi.Map{
+						"type": pulumi.String("Info"),
+						"info": pulumi.Map{
+							"labelsFromPath": pulumi.Map{
+								"name": pulumi.ToStringArray([]string{"metadata", "name"}),
+							},
+						},
+					},
+					"labelsFromPath": pulumi.Map{
+						"exported_namespace": pulumi.ToStringArray([]string{"metadata", "namespace"}),
+						"ready":              pulumi.ToStringArray([]string{"status", "conditions", "[type=Ready]", "status"}),
+						"suspended":          pulumi.ToStringArray([]string{"spec", "suspend"}),
+					},
+				},
+			},
+		})
+		if _, ok := rules[kind.group]; !ok {
+			groups = append(groups, kind.group)
+		}
+		rules[kind.group] = append(rules[kind.group], pulumi.String(kind.resource))
+	}
+
+	var rbacRules pulumi.Array
+	for _, group := range groups {
+		rbacRules = append(rbacRules, pulumi.Map{
+			"apiGroups": pulumi.StringArray{
+				pulumi.String(group),
+			},
+			"resources": rules[group],
+			"verbs": pulumi.StringArray{
+				pulumi.String("list"),
+				pulumi.String("watch"),
+			},
+		})
+	}
+	return pulumi.Map{
+		"spec": pulumi.Map{
+			"resources": resources,
+		},
+	}, rbacRules
+}
+
+// newPrometheusRemoteWrite creates the Amazon Managed Prometheus workspace and
+// an IRSA role for Prometheus, and returns the remote-write config and the role.
+func newPrometheusRemoteWrite(ctx *pulumi.Context, cluster *eks.Cluster) (pulumi.Array, *iam.Role, error) {
+	workspace, err := amp.NewWorkspace(ctx, "pulumi-backstage-flux-gitops-aws-prometheus", &amp.WorkspaceArgs{
+		Alias: pulumi.String(clusterName),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.Export("prometheus-workspace-endpoint", workspace.PrometheusEndpoint)
+
+	role, err := newIRSARole(ctx, "prometheus-role", cluster, monitoringNamespace, prometheusServiceAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("aps:RemoteWrite"),
+				},
+				Resources: pulumi.StringArray{
+					workspace.Arn,
+				},
+			},
+		},
+	})
+
+	_, err = iam.NewRolePolicy(ctx, "prometheus-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pulumi.Array{
+		pulumi.Map{
+			"url": pulumi.Sprintf("%sapi/v1/remote_write", workspace.PrometheusEndpoint),
+			"sigv4": pulumi.Map{
+				"region": pulumi.String(region),
+			},
+		},
+	}, role, nil
+}
+
+// installMonitoring deploys kube-prometheus-stack with PodMonitors, Grafana
+// dashboards and alerting rules for Flux. It returns the Grafana admin password.
+func installMonitoring(ctx *pulumi.Context, cfg monitoringConfig, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (pulumi.StringOutput, error) {
+	grafanaPassword, err := random.NewRandomPassword(ctx, "pulumi-backstage-flux-gitops-aws-grafana-admin-password", &random.RandomPasswordArgs{
+		Length:  pulumi.Int(24),
+		Special: pulumi.Bool(false),
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	prometheusSpec := pulumi.Map{
+		"priorityClassName":                       pulumi.String(platformPriorityClass),
+		"podMonitorSelectorNilUsesHelmValues":     pulumi.Bool(false),
+		"serviceMonitorSelectorNilUsesHelmValues": pulumi.Bool(false),
+		"ruleSelectorNilUsesHelmValues":           pulumi.Bool(false),
+	}
+	prometheusServiceAccountValues := pulumi.Map{
+		"name": pulumi.String(prometheusServiceAccount),
+	}
+	if cfg.AmazonManagedPrometheus {
+		remoteWrite, role, err := newPrometheusRemoteWrite(ctx, cluster)
+		if err != nil {
+			return pulumi.StringOutput{}, err
+		}
+		prometheusSpec["remoteWrite"] = remoteWrite
+		prometheusServiceAccountValues["annotations"] = pulumi.StringMap{
+			"eks.amazonaws.com/role-arn": role.Arn,
+		}
+	}
+
+	dashboards := pulumi.Map{}
+	for _, dashboard := range []string{"cluster", "control-plane"} {
+		if cfg.FluxDashboardsRef != "" {
+			dashboards["flux-"+dashboard] = pulumi.Map{
+				"url":        pulumi.Sprintf("%s/%s.json", fmt.Sprintf(fluxDashboardsURL, cfg.FluxDashboardsRef), dashboard),
+				"datasource": pulumi.String("Prometheus"),
+			}
+			continue
+		}
+		content, err := fluxDashboards.ReadFile(path.Join("dashboards", "flux", dashboard+".json"))
+		if err != nil {
+			return pulumi.StringOutput{}, err
+		}
+		dashboards["flux-"+dashboard] = pulumi.Map{
+			"json": pulumi.String(string(content)),
+		}
+	}
+	customResourceState, stateMetricsRules := fluxStateMetrics()
+
+	// every component runs a single replica, Prometheus and Alertmanager keep their
+	// data on a volume of one zone, so they get no disruption budget
+	stack, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-kube-prometheus-stack", &helm.ReleaseArgs{
+		Chart:           pulumi.String("kube-prometheus-stack"),
+		Namespace:       pulumi.String(monitoringNamespace),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("56.21.1"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://prometheus-community.github.io/helm-charts"),
+		},
+		Values: pulumi.Map{
+			"prometheusOperator": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"prometheus": pulumi.Map{
+				"serviceAccount": prometheusServiceAccountValues,
+				"prometheusSpec": prometheusSpec,
+			},
+			"alertmanager": pulumi.Map{
+				"alertmanagerSpec": pulumi.Map{
+					"priorityClassName": pulumi.String(platformPriorityClass),
+				},
+			},
+			"grafana": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+				"adminPassword":     grafanaPassword.Result,
+				"dashboardProviders": pulumi.Map{
+					"dashboardproviders.yaml": pulumi.Map{
+						"apiVersion": pulumi.Int(1),
+						"providers": pulumi.Array{
+							pulumi.Map{
+								"name":            pulumi.String("flux"),
+								"folder":          pulumi.String("Flux"),
+								"type":            pulumi.String("file"),
+								"disableDeletion": pulumi.Bool(false),
+								"editable":        pulumi.Bool(true),
+								"options": pulumi.Map{
+									"path": pulumi.String("/var/lib/grafana/dashboards/flux"),
+								},
+							},
+						},
+					},
+				},
+				"dashboards": pulumi.Map{
+					"flux": dashboards,
+				},
+			},
+			"kube-state-metrics": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+				// expose the Backstage component of pods and namespaces for cost allocation
+				"metricLabelsAllowlist": pulumi.StringArray{
+					pulumi.String("pods=[backstage.io/kubernetes-id]"),
+					pulumi.String("namespaces=[backstage.io/kubernetes-id]"),
+				},
+				"rbac": pulumi.Map{
+					"extraRules": stateMetricsRules,
+				},
+				"customResourceState": pulumi.Map{
+					"enabled": pulumi.Bool(true),
+					"config":  customResourceState,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	for _, controller := range fluxControllers {
+		_, err = apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-pod-monitor", controller), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("monitoring.coreos.com/v1"),
+			Kind:       pulumi.String("PodMonitor"),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String(controller),
+				Namespace: pulumi.String(fluxNamespace),
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": pulumi.Map{
+					"selector": pulumi.Map{
+						"matchLabels": pulumi.StringMap{
+							"app": pulumi.String(controller),
+						},
+					},
+					"podMetricsEndpoints": pulumi.Array{
+						pulumi.Map{
+							"port": pulumi.String("http-prom"),
+						},
+					},
+				},
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{stack}))
+		if err != nil {
+			return pulumi.StringOutput{}, err
+		}
+	}
+
+	_, err = apiextensions.NewCustomResource(ctx, "pulumi-backstage-flux-gitops-aws-flux-prometheus-rules", &apiextensions.CustomResourceArgs{
+		ApiVersion: pulumi.String("monitoring.coreos.com/v1"),
+		Kind:       pulumi.String("PrometheusRule"),
+		Metadata: &metav1.ObjectMetaArgs{
+			Name:      pulumi.String("flux"),
+			Namespace: pulumi.String(monitoringNamespace),
+		},
+		OtherFields: kubernetes.UntypedArgs{
+			"spec": pulumi.Map{
+				"groups": pulumi.Array{
+					pulumi.Map{
+						"name": pulumi.String("flux"),
+						"rules": pulumi.Array{
+							pulumi.Map{
+								"alert": pulumi.String("FluxReconciliationFailure"),
+								"expr":  pulumi.String(`max by (customresource_kind, exported_namespace, name) (gotk_resource_info{ready="False"}) > 0`),
+								"for":   pulumi.String("10m"),
+								"labels": pulumi.StringMap{
+									"severity": pulumi.String("critical"),
+								},
+								"annotations": pulumi.StringMap{
+									"summary": pulumi.String("{{ $labels.customresource_kind }} {{ $labels.exported_namespace }}/{{ $labels.name }} has been failing to reconcile for 10 minutes."),
+								},
+							},
+							pulumi.Map{
+								"alert": pulumi.String("FluxResourceSuspended"),
+								"expr":  pulumi.String(`max by (customresource_kind, exported_namespace, name) (gotk_resource_info{suspended="true"}) > 0`),
+								"for":   pulumi.String("1h"),
+								"labels": pulumi.StringMap{
+									"severity": pulumi.String("warning"),
+								},
+								"annotations": pulumi.StringMap{
+									"summary": pulumi.String("{{ $labels.customresource_kind }} {{ $labels.exported_namespace }}/{{ $labels.name }} has been suspended for an hour."),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{stack}))
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+	return grafanaPassword.Result, nil
+}
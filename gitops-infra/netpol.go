@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	networkingv1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/networking/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// networkPolicyConfig is read from the `networkPolicy` config key.
+type networkPolicyConfig struct {
+	Enabled bool `json:"enabled"`
+	// Engine enforces the network policies, either vpc-cni (default) or calico.
+	Engine string `json:"engine"`
+}
+
+func (c networkPolicyConfig) withDefaults() networkPolicyConfig {
+	if c.Engine == "" {
+		c.Engine = "vpc-cni"
+	}
+	return c
+}
+
+// enableVpcCniNetworkPolicy turns on the network policy agent of the managed VPC CNI add-on.
+func enableVpcCniNetworkPolicy(addons map[string]addonConfig) error {
+	vpcCni, ok := addons["vpc-cni"]
+	if !ok {
+		return fmt.Errorf("the vpc-cni network policy engine needs the vpc-cni add-on in eksAddons")
+	}
+	values := map[string]interface{}{}
+	for key, value := range vpcCni.ConfigurationValues {
+		values[key] = value
+	}
+	values["enableNetworkPolicy"] = "true"
+	vpcCni.ConfigurationValues = values
+	addons["vpc-cni"] = vpcCni
+	return nil
+}
+
+// installCalico deploys the Tigera operator with Calico in policy-only mode on top of the VPC CNI.
+// The operator assigns the Calico components the system priority classes and
+// a disruption budget to Typha, calico-node is a DaemonSet that drains don't evict.
+func installCalico(ctx *pulumi.Context, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (*helm.Release, error) {
+	return helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-calico", &helm.ReleaseArgs{
+		Chart:           pulumi.String("tigera-operator"),
+		Namespace:       pulumi.String("tigera-operator"),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("v3.27.2"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://docs.tigera.io/calico/charts"),
+		},
+		Values: pulumi.Map{
+			"installation": pulumi.Map{
+				"kubernetesProvider": pulumi.String("EKS"),
+				"cni": pulumi.Map{
+					"type": pulumi.String("AmazonVPC"),
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+}
+
+func namespacePeer(namespace string) *networkingv1.NetworkPolicyPeerArgs {
+	return &networkingv1.NetworkPolicyPeerArgs{
+		NamespaceSelector: &metav1.LabelSelectorArgs{
+			MatchLabels: pulumi.StringMap{
+				namespaceNameLabel: pulumi.String(namespace),
+			},
+		},
+	}
+}
+
+func cidrPeer(cidr pulumi.StringInput) *networkingv1.NetworkPolicyPeerArgs {
+	return &networkingv1.NetworkPolicyPeerArgs{
+		IpBlock: &networkingv1.IPBlockArgs{
+			Cidr: cidr,
+		},
+	}
+}
+
+func tcpPorts(ports ...int) networkingv1.NetworkPolicyPortArray {
+	var policyPorts networkingv1.NetworkPolicyPortArray
+	for _, port := range ports {
+		policyPorts = append(policyPorts, &networkingv1.NetworkPolicyPortArgs{
+			Protocol: pulumi.String("TCP"),
+			Port:     pulumi.Int(port),
+		})
+	}
+	return policyPorts
+}
+
+// platformEgress returns the egress every platform namespace needs: DNS
+// through CoreDNS and the API server, whose endpoint ENIs live in the VPC.
+func platformEgress(vpcCidr pulumi.StringInput) networkingv1.NetworkPolicyEgressRuleArray {
+	return networkingv1.NetworkPolicyEgressRuleArray{
+		&networkingv1.NetworkPolicyEgressRuleArgs{
+			To: networkingv1.NetworkPolicyPeerArray{
+				&networkingv1.NetworkPolicyPeerArgs{
+					NamespaceSelector: namespacePeer("kube-system").NamespaceSelector,
+					PodSelector: &metav1.LabelSelectorArgs{
+						MatchLabels: pulumi.StringMap{
+							"k8s-app": pulumi.String("kube-dns"),
+						},
+					},
+				},
+			},
+			Ports: networkingv1.NetworkPolicyPortArray{
+				&networkingv1.NetworkPolicyPortArgs{
+					Protocol: pulumi.String("UDP"),
+					Port:     pulumi.Int(53),
+				},
+				&networkingv1.NetworkPolicyPortArgs{
+					Protocol: pulumi.String("TCP"),
+					Port:     pulumi.Int(53),
+				},
+			},
+		},
+		&networkingv1.NetworkPolicyEgressRuleArgs{
+			To: networkingv1.NetworkPolicyPeerArray{
+				cidrPeer(vpcCidr),
+			},
+			Ports: tcpPorts(443),
+		},
+	}
+}
+
+// platformNetworkPolicyRules returns the traffic each platform namespace is
+// allowed on top of the default deny.
+func platformNetworkPolicyRules(namespace string, vpcCidr pulumi.StringInput) (networkingv1.NetworkPolicyIngressRuleArray, networkingv1.NetworkPolicyEgressRuleArray) {
+	var ingress networkingv1.NetworkPolicyIngressRuleArray
+	egress := platformEgress(vpcCidr)
+	switch namespace {
+	case fluxNamespace:
+		// the controllers talk to each other, fetch sources from Git, Helm and OCI repositories,
+		// the Pulumi operator fetches artifacts from the source-controller and Prometheus scrapes the controllers
+		ingress = append(ingress,
+			&networkingv1.NetworkPolicyIngressRuleArgs{
+				From: networkingv1.NetworkPolicyPeerArray{
+					namespacePeer(fluxNamespace),
+				},
+			},
+			&networkingv1.NetworkPolicyIngressRuleArgs{
+				From: networkingv1.NetworkPolicyPeerArray{
+					namespacePeer(operatorNamespace),
+				},
+				Ports: tcpPorts(9090),
+			},
+			&networkingv1.NetworkPolicyIngressRuleArgs{
+				From: networkingv1.NetworkPolicyPeerArray{
+					namespacePeer(monitoringNamespace),
+				},
+				Ports: tcpPorts(8080),
+			},
+		)
+		egress = append(egress,
+			&networkingv1.NetworkPolicyEgressRuleArgs{
+				To: networkingv1.NetworkPolicyPeerArray{
+					namespacePeer(fluxNamespace),
+				},
+			},
+			&networkingv1.NetworkPolicyEgressRuleArgs{
+				To: networkingv1.NetworkPolicyPeerArray{
+					cidrPeer(pulumi.String("0.0.0.0/0")),
+				},
+				Ports: tcpPorts(22, 443),
+			},
+		)
+	case operatorNamespace:
+		// the operator reaches Pulumi Cloud, the cloud APIs and the Flux sources
+		egress = append(egress,
+			&networkingv1.NetworkPolicyEgressRuleArgs{
+				To: networkingv1.NetworkPolicyPeerArray{
+					namespacePeer(fluxNamespace),
+				},
+				Ports: tcpPorts(9090),
+			},
+			&networkingv1.NetworkPolicyEgressRuleArgs{
+				To: networkingv1.NetworkPolicyPeerArray{
+					cidrPeer(pulumi.String("0.0.0.0/0")),
+				},
+				Ports: tcpPorts(443),
+			},
+		)
+	case albNamespace:
+		// the API server calls the admission webhook, the controller calls the AWS APIs
+		ingress = append(ingress,
+			&networkingv1.NetworkPolicyIngressRuleArgs{
+				From: networkingv1.NetworkPolicyPeerArray{
+					cidrPeer(vpcCidr),
+				},
+				Ports: tcpPorts(9443),
+			},
+		)
+		egress = append(egress,
+			&networkingv1.NetworkPolicyEgressRuleArgs{
+				To: networkingv1.NetworkPolicyPeerArray{
+					cidrPeer(pulumi.String("0.0.0.0/0")),
+				},
+				Ports: tcpPorts(443),
+			},
+		)
+	}
+	return ingress, egress
+}
+
+// newPlatformNetworkPolicies applies a default-deny ingress/egress policy and
+// the generated allow rules to every platform namespace.
+func newPlatformNetworkPolicies(ctx *pulumi.Context, vpcCidr pulumi.StringInput, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	opts = append(opts, pulumi.Provider(provider))
+	for _, namespace := range []string{fluxNamespace, operatorNamespace, albNamespace} {
+		_, err := networkingv1.NewNetworkPolicy(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-default-deny", namespace), &networkingv1.NetworkPolicyArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String("default-deny"),
+				Namespace: pulumi.String(namespace),
+			},
+			Spec: &networkingv1.NetworkPolicySpecArgs{
+				PodSelector: &metav1.LabelSelectorArgs{},
+				PolicyTypes: pulumi.StringArray{
+					pulumi.String("Ingress"),
+					pulumi.String("Egress"),
+				},
+			},
+		}, opts...)
+		if err != nil {
+			return err
+		}
+
+		ingress, egress := platformNetworkPolicyRules(namespace, vpcCidr)
+		_, err = networkingv1.NewNetworkPolicy(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-allow-platform", namespace), &networkingv1.NetworkPolicyArgs{
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String("allow-platform"),
+				Namespace: pulumi.String(namespace),
+			},
+			Spec: &networkingv1.NetworkPolicySpecArgs{
+				PodSelector: &metav1.LabelSelectorArgs{},
+				PolicyTypes: pulumi.StringArray{
+					pulumi.String("Ingress"),
+					pulumi.String("Egress"),
+				},
+				Ingress: ingress,
+				Egress:  egress,
+			},
+		}, opts...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// The private subnets reach the internet through a NAT gateway, or only the AWS
+// APIs through the VPC endpoints. Set with the `privateEgress` config key.
+const (
+	egressNat       = "nat"
+	egressEndpoints = "endpoints"
+)
+
+// backstageTierTag marks the subnets backstage-infra adds to the VPC. They are
+// allocated around the used subnets, so they must not count as used themselves.
+const backstageTierTag = "pulumi-backstage-aws/tier"
+
+// existingVpcConfig is read from the `existingVpc` config key. When a VPC is
+// selected, the program uses it instead of creating its own network.
+type existingVpcConfig struct {
+	// VpcId selects the VPC, otherwise it's looked up by Tags.
+	VpcId string            `json:"vpcId"`
+	Tags  map[string]string `json:"tags"`
+	// SubnetIds are the subnets per tier, public and private.
+	SubnetIds map[string][]string `json:"subnetIds"`
+	// SubnetTags look up the subnets of the tiers without SubnetIds.
+	SubnetTags map[string]map[string]string `json:"subnetTags"`
+	// RouteTableId is shared with the other programs in the VPC. It defaults to
+	// the route table of the first public subnet.
+	RouteTableId string `json:"routeTableId"`
+}
+
+func (c existingVpcConfig) enabled() bool {
+	return c.VpcId != "" || len(c.Tags) > 0
+}
+
+// vpcNetwork is the network the cluster runs in, either created or looked up.
+type vpcNetwork struct {
+	vpcId            pulumi.StringInput
+	vpcCidr          pulumi.StringOutput
+	routeTableId     pulumi.StringInput
+	publicSubnetIDs  pulumi.StringArray
+	privateSubnetIDs pulumi.StringArray
+	// privateRouteTableIds route the private subnets, if they don't use routeTableId.
+	privateRouteTableIds pulumi.StringArray
+	// usedSubnetCidrs are left alone by the programs sharing the VPC.
+	usedSubnetCidrs []string
+}
+
+// newVpcNetwork creates the VPC with a public subnet per availability zone.
+func newVpcNetwork(ctx *pulumi.Context) (*vpcNetwork, error) {
+	vpc, err := ec2.NewVpc(ctx, "pulumi-backstage-flux-gitops-aws-vpc", &ec2.VpcArgs{
+		CidrBlock:          pulumi.String("10.0.0.0/24"),
+		EnableDnsSupport:   pulumi.Bool(true),
+		EnableDnsHostnames: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	igw, err := ec2.NewInternetGateway(ctx, "pulumi-backstage-flux-gitops-aws-igw", &ec2.InternetGatewayArgs{
+		VpcId: vpc.ID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := ec2.NewRouteTable(ctx, "pulumi-backstage-flux-gitops-aws-rt", &ec2.RouteTableArgs{
+		VpcId: vpc.ID(),
+		Routes: ec2.RouteTableRouteArray{
+			&ec2.RouteTableRouteArgs{
+				CidrBlock: pulumi.String("0.0.0.0/0"),
+				GatewayId: igw.ID(),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var publicSubnetIDs pulumi.StringArray
+
+	// Create a subnet for each availability zone
+	for i, az := range availabilityZones {
+		publicSubnet, err := ec2.NewSubnet(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-subnet-%d", i), &ec2.SubnetArgs{
+			VpcId:                       vpc.ID(),
+			CidrBlock:                   pulumi.String(publicSubnetCidrs[i]),
+			MapPublicIpOnLaunch:         pulumi.Bool(false),
+			AssignIpv6AddressOnCreation: pulumi.Bool(false),
+			AvailabilityZone:            pulumi.String(az),
+			Tags: pulumi.StringMap{
+				"Name": pulumi.Sprintf("pulumi-backstage-flux-gitops-aws-subnet-%d", az),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = ec2.NewRouteTableAssociation(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-rt-association-%s", az), &ec2.RouteTableAssociationArgs{
+			RouteTableId: rt.ID(),
+			SubnetId:     publicSubnet.ID(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		publicSubnetIDs = append(publicSubnetIDs, publicSubnet.ID())
+	}
+
+	return &vpcNetwork{
+		vpcId:           vpc.ID(),
+		vpcCidr:         vpc.CidrBlock,
+		routeTableId:    rt.ID(),
+		publicSubnetIDs: publicSubnetIDs,
+		usedSubnetCidrs: append([]string{}, publicSubnetCidrs...),
+	}, nil
+}
+
+// lookupVpcNetwork resolves an existing VPC without creating any resources.
+// Every tier has to span the availability zones of the cluster.
+func lookupVpcNetwork(ctx *pulumi.Context, cfg existingVpcConfig, tiers []string) (*vpcNetwork, error) {
+	vpcArgs := &ec2.LookupVpcArgs{
+		Tags: cfg.Tags,
+	}
+	if cfg.VpcId != "" {
+		vpcArgs.Id = pulumi.StringRef(cfg.VpcId)
+	}
+	vpc, err := ec2.LookupVpc(ctx, vpcArgs)
+	if err != nil {
+		return nil, err
+	}
+	vpcFilter := ec2.GetSubnetsFilter{
+		Name:   "vpc-id",
+		Values: []string{vpc.Id},
+	}
+
+	// every subnet of the VPC, to validate the tiers and to keep their CIDRs free
+	allSubnets, err := ec2.GetSubnets(ctx, &ec2.GetSubnetsArgs{
+		Filters: []ec2.GetSubnetsFilter{vpcFilter},
+	})
+	if err != nil {
+		return nil, err
+	}
+	backstageSubnets, err := ec2.GetSubnets(ctx, &ec2.GetSubnetsArgs{
+		Filters: []ec2.GetSubnetsFilter{
+			vpcFilter,
+			{Name: "tag-key", Values: []string{backstageTierTag}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	skip := map[string]bool{}
+	for _, id := range backstageSubnets.Ids {
+		skip[id] = true
+	}
+
+	// subnets only returns IDs, the CIDRs and zones need a lookup per subnet
+	subnets := map[string]*ec2.LookupSubnetResult{}
+	var usedSubnetCidrs []string
+	for _, id := range allSubnets.Ids {
+		if skip[id] {
+			continue
+		}
+		subnet, err := ec2.LookupSubnet(ctx, &ec2.LookupSubnetArgs{
+			Id: pulumi.StringRef(id),
+		})
+		if err != nil {
+			return nil, err
+		}
+		subnets[id] = subnet
+		usedSubnetCidrs = append(usedSubnetCidrs, subnet.CidrBlock)
+	}
+	sort.Strings(usedSubnetCidrs)
+
+	subnetIDs := map[string][]string{}
+	for _, tier := range tiers {
+		ids, ok := cfg.SubnetIds[tier]
+		if !ok {
+			tags, ok := cfg.SubnetTags[tier]
+			if !ok {
+				return nil, fmt.Errorf("existingVpc needs subnetIds or subnetTags for the %s subnets", tier)
+			}
+			tagged, err := ec2.GetSubnets(ctx, &ec2.GetSubnetsArgs{
+				Filters: []ec2.GetSubnetsFilter{vpcFilter},
+				Tags:    tags,
+			})
+			if err != nil {
+				return nil, err
+			}
+			ids = tagged.Ids
+		}
+		ids, err = sortSubnetsByZone(tier, vpc.Id, ids, subnets)
+		if err != nil {
+			return nil, err
+		}
+		subnetIDs[tier] = ids
+	}
+
+	routeTableId := cfg.RouteTableId
+	if routeTableId == "" {
+		routeTableId, err = lookupRouteTableID(ctx, vpc.Id, subnetIDs["public"][0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the S3 gateway endpoint needs every route table of the private subnets
+	seen := map[string]bool{routeTableId: true}
+	var privateRouteTableIds []string
+	for _, subnetId := range subnetIDs["private"] {
+		privateRouteTableId, err := lookupRouteTableID(ctx, vpc.Id, subnetId)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[privateRouteTableId] {
+			seen[privateRouteTableId] = true
+			privateRouteTableIds = append(privateRouteTableIds, privateRouteTableId)
+		}
+	}
+
+	return &vpcNetwork{
+		vpcId:                pulumi.String(vpc.Id),
+		vpcCidr:              pulumi.String(vpc.CidrBlock).ToStringOutput(),
+		routeTableId:         pulumi.String(routeTableId),
+		publicSubnetIDs:      pulumi.ToStringArray(subnetIDs["public"]),
+		privateSubnetIDs:     pulumi.ToStringArray(subnetIDs["private"]),
+		privateRouteTableIds: pulumi.ToStringArray(privateRouteTableIds),
+		usedSubnetCidrs:      usedSubnetCidrs,
+	}, nil
+}
+
+// sortSubnetsByZone orders the subnets of a tier like availabilityZones and
+// fails unless they belong to the VPC and cover every zone.
+func sortSubnetsByZone(tier, vpcId string, ids []string, subnets map[string]*ec2.LookupSubnetResult) ([]string, error) {
+	zoneIndex := map[string]int{}
+	for i, az := range availabilityZones {
+		zoneIndex[az] = i
+	}
+
+	covered := map[string]bool{}
+	for _, id := range ids {
+		subnet, ok := subnets[id]
+		if !ok {
+			return nil, fmt.Errorf("%s subnet %s is not in VPC %s", tier, id, vpcId)
+		}
+		if _, ok := zoneIndex[subnet.AvailabilityZone]; !ok {
+			return nil, fmt.Errorf("%s subnet %s is in %s, outside of the availability zones %s", tier, id, subnet.AvailabilityZone, strings.Join(availabilityZones, ", "))
+		}
+		covered[subnet.AvailabilityZone] = true
+	}
+	for _, az := range availabilityZones {
+		if !covered[az] {
+			return nil, fmt.Errorf("the %s subnets of VPC %s don't cover availability zone %s", tier, vpcId, az)
+		}
+	}
+
+	sorted := append([]string{}, ids...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return zoneIndex[subnets[sorted[i]].AvailabilityZone] < zoneIndex[subnets[sorted[j]].AvailabilityZone]
+	})
+	return sorted, nil
+}
+
+// lookupRouteTableID returns the route table of the subnet, which is the main
+// route table of the VPC unless the subnet has one associated explicitly.
+func lookupRouteTableID(ctx *pulumi.Context, vpcId, subnetId string) (string, error) {
+	filters := [][]ec2.GetRouteTablesFilter{
+		{{Name: "association.subnet-id", Values: []string{subnetId}}},
+		{{Name: "association.main", Values: []string{"true"}}},
+	}
+	for _, filter := range filters {
+		routeTables, err := ec2.GetRouteTables(ctx, &ec2.GetRouteTablesArgs{
+			VpcId:   pulumi.StringRef(vpcId),
+			Filters: filter,
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(routeTables.Ids) > 0 {
+			return routeTables.Ids[0], nil
+		}
+	}
+	return "", fmt.Errorf("VPC %s has no route table for subnet %s", vpcId, subnetId)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/ec2"
+	awseks "github.com/pulumi/pulumi-aws/sdk/v6/go/aws/eks"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// amiTypes maps the supported AMI families to the EKS managed node group AMI types.
+var amiTypes = map[string]string{
+	"AL2023":       "AL2023_x86_64_STANDARD",
+	"Bottlerocket": "BOTTLEROCKET_x86_64",
+}
+
+// nodeConfig is read from the `nodes` config key. The launch settings are
+// shared by every node group through a single launch template.
+type nodeConfig struct {
+	// AmiFamily is either AL2023 or Bottlerocket.
+	AmiFamily string `json:"amiFamily"`
+	// MetadataHopLimit is the IMDSv2 PUT response hop limit.
+	MetadataHopLimit int              `json:"metadataHopLimit"`
+	RootVolume       rootVolumeConfig `json:"rootVolume"`
+	// UserData is merged by EKS with its own bootstrap. It's a nodeadm
+	// NodeConfig or shell script for AL2023, and TOML settings for Bottlerocket.
+	UserData           string                     `json:"userData"`
+	SecurityGroupRules []securityGroupRuleConfig  `json:"securityGroupRules"`
+	Groups             map[string]nodeGroupConfig `json:"groups"`
+}
+
+type rootVolumeConfig struct {
+	Size int    `json:"size"`
+	Type string `json:"type"`
+	// KmsKeyArn encrypts the volume with a customer managed key instead of
+	// aws/ebs. Its key policy must allow the EC2 Auto Scaling service role.
+	KmsKeyArn string `json:"kmsKeyArn"`
+}
+
+// securityGroupRuleConfig is an additional rule of the node security group.
+type securityGroupRuleConfig struct {
+	// Type is either ingress or egress.
+	Type        string   `json:"type"`
+	Protocol    string   `json:"protocol"`
+	FromPort    int      `json:"fromPort"`
+	ToPort      int      `json:"toPort"`
+	CidrBlocks  []string `json:"cidrBlocks"`
+	Description string   `json:"description"`
+}
+
+type nodeGroupConfig struct {
+	InstanceTypes []string          `json:"instanceTypes"`
+	CapacityType  string            `json:"capacityType"`
+	DesiredSize   int               `json:"desiredSize"`
+	MinSize       int               `json:"minSize"`
+	MaxSize       int               `json:"maxSize"`
+	Labels        map[string]string `json:"labels"`
+}
+
+func (c nodeConfig) withDefaults() nodeConfig {
+	if c.AmiFamily == "" {
+		c.AmiFamily = "AL2023"
+	}
+	if c.MetadataHopLimit == 0 {
+		c.MetadataHopLimit = 2
+	}
+	if c.RootVolume.Size == 0 {
+		c.RootVolume.Size = 20
+	}
+	if c.RootVolume.Type == "" {
+		c.RootVolume.Type = "gp3"
+	}
+	if c.Groups == nil {
+		c.Groups = map[string]nodeGroupConfig{
+			"default": {
+				InstanceTypes: []string{"t3.medium"},
+				DesiredSize:   2,
+				MinSize:       1,
+				MaxSize:       3,
+			},
+		}
+	}
+	for name, group := range c.Groups {
+		if group.CapacityType == "" {
+			group.CapacityType = "ON_DEMAND"
+			c.Groups[name] = group
+		}
+	}
+	return c
+}
+
+// blockDevice is a volume of the launch template. A zero size keeps the size
+// of the AMI snapshot.
+type blockDevice struct {
+	name string
+	size int
+}
+
+// rootDevices returns the block devices to encrypt, Bottlerocket keeps its
+// container images and pod data on a second volume next to the OS volume.
+// The root volume size applies to the data volume then.
+func (c nodeConfig) rootDevices() []blockDevice {
+	if c.AmiFamily == "Bottlerocket" {
+		return []blockDevice{
+			{name: "/dev/xvda"},
+			{name: "/dev/xvdb", size: c.RootVolume.Size},
+		}
+	}
+	return []blockDevice{{name: "/dev/xvda", size: c.RootVolume.Size}}
+}
+
+// encodedUserData returns the base64 encoded launch template user data. AL2023
+// only accepts MIME multi-part user data in a launch template.
+func (c nodeConfig) encodedUserData() string {
+	if c.UserData == "" {
+		return ""
+	}
+	userData := c.UserData
+	if c.AmiFamily == "AL2023" {
+		contentType := "application/node.eks.aws"
+		if strings.HasPrefix(userData, "#!") {
+			contentType = "text/x-shellscript"
+		}
+		userData = fmt.Sprintf(`MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="BOUNDARY"
+
+--BOUNDARY
+Content-Type: %s
+
+%s
+
+--BOUNDARY--
+`, contentType, userData)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(userData))
+}
+
+// newNodeRole creates the IAM role of the worker nodes. It has to be passed to
+// the cluster as an instance role so the nodes are mapped in aws-auth.
+func newNodeRole(ctx *pulumi.Context) (*iam.Role, error) {
+	assumeRolePolicy, err := iam.GetPolicyDocument(ctx, &iam.GetPolicyDocumentArgs{
+		Statements: []iam.GetPolicyDocumentStatement{
+			{
+				Effect: pulumi.StringRef("Allow"),
+				Actions: []string{
+					"sts:AssumeRole",
+				},
+				Principals: []iam.GetPolicyDocumentStatementPrincipal{
+					{
+						Type: "Service",
+						Identifiers: []string{
+							"ec2.amazonaws.com",
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	role, err := iam.NewRole(ctx, "pulumi-backstage-flux-gitops-aws-node-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(assumeRolePolicy.Json),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, policy := range []string{
+		"arn:aws:iam::aws:policy/AmazonEKSWorkerNodePolicy",
+		"arn:aws:iam::aws:policy/AmazonEKS_CNI_Policy",
+		"arn:aws:iam::aws:policy/AmazonEC2ContainerRegistryReadOnly",
+		"arn:aws:iam::aws:policy/AmazonSSMManagedInstanceCore",
+	} {
+		_, err = iam.NewRolePolicyAttachment(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-node-role-attachment-%d", i), &iam.RolePolicyAttachmentArgs{
+			PolicyArn: pulumi.String(policy),
+			Role:      role.Name,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return role, nil
+}
+
+// newNodeGroups creates the launch template with the hardened node settings and
+// one managed node group per configured group. The node groups follow the
+// control-plane version, so they roll only after the control plane is upgraded.
+func newNodeGroups(ctx *pulumi.Context, cfg nodeConfig, cluster *eks.Cluster, nodeRole *iam.Role, subnetIDs pulumi.StringArrayInput) ([]pulumi.Resource, error) {
+	amiType, ok := amiTypes[cfg.AmiFamily]
+	if !ok {
+		return nil, fmt.Errorf("unsupported node AMI family %q, use AL2023 or Bottlerocket", cfg.AmiFamily)
+	}
+
+	nodeSecurityGroupID := cluster.NodeSecurityGroup.ApplyT(func(sg *ec2.SecurityGroup) pulumi.StringOutput {
+		return sg.ID().ToStringOutput()
+	}).(pulumi.StringOutput)
+
+	for i, rule := range cfg.SecurityGroupRules {
+		_, err := ec2.NewSecurityGroupRule(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-node-sg-rule-%d", i), &ec2.SecurityGroupRuleArgs{
+			SecurityGroupId: nodeSecurityGroupID,
+			Type:            pulumi.String(rule.Type),
+			Protocol:        pulumi.String(rule.Protocol),
+			FromPort:        pulumi.Int(rule.FromPort),
+			ToPort:          pulumi.Int(rule.ToPort),
+			CidrBlocks:      pulumi.ToStringArray(rule.CidrBlocks),
+			Description:     pulumi.String(rule.Description),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var blockDevices ec2.LaunchTemplateBlockDeviceMappingArray
+	for _, device := range cfg.rootDevices() {
+		ebs := &ec2.LaunchTemplateBlockDeviceMappingEbsArgs{
+			VolumeType:          pulumi.String(cfg.RootVolume.Type),
+			Encrypted:           pulumi.String("true"),
+			DeleteOnTermination: pulumi.String("true"),
+		}
+		if device.size > 0 {
+			ebs.VolumeSize = pulumi.Int(device.size)
+		}
+		if cfg.RootVolume.KmsKeyArn != "" {
+			ebs.KmsKeyId = pulumi.String(cfg.RootVolume.KmsKeyArn)
+		}
+		blockDevices = append(blockDevices, &ec2.LaunchTemplateBlockDeviceMappingArgs{
+			DeviceName: pulumi.String(device.name),
+			Ebs:        ebs,
+		})
+	}
+
+	launchTemplateArgs := &ec2.LaunchTemplateArgs{
+		UpdateDefaultVersion: pulumi.Bool(true),
+		MetadataOptions: &ec2.LaunchTemplateMetadataOptionsArgs{
+			HttpEndpoint:            pulumi.String("enabled"),
+			HttpTokens:              pulumi.String("required"),
+			HttpPutResponseHopLimit: pulumi.Int(cfg.MetadataHopLimit),
+		},
+		BlockDeviceMappings: blockDevices,
+		// the node subnets don't map public IPs on launch, the nodes reach ECR and the API server through the internet gateway
+		NetworkInterfaces: ec2.LaunchTemplateNetworkInterfaceArray{
+			&ec2.LaunchTemplateNetworkInterfaceArgs{
+				AssociatePublicIpAddress: pulumi.String("true"),
+				DeleteOnTermination:      pulumi.String("true"),
+				SecurityGroups: pulumi.StringArray{
+					nodeSecurityGroupID,
+					cluster.EksCluster.VpcConfig().ClusterSecurityGroupId().Elem(),
+				},
+			},
+		},
+	}
+	if userData := cfg.encodedUserData(); userData != "" {
+		launchTemplateArgs.UserData = pulumi.String(userData)
+	}
+	launchTemplate, err := ec2.NewLaunchTemplate(ctx, "pulumi-backstage-flux-gitops-aws-node-launch-template", launchTemplateArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(cfg.Groups))
+	for name := range cfg.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var nodeGroups []pulumi.Resource
+	for _, name := range names {
+		group := cfg.Groups[name]
+		nodeGroup, err := eks.NewManagedNodeGroup(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-node-group", name), &eks.ManagedNodeGroupArgs{
+			Cluster:       cluster.Core,
+			NodeRole:      nodeRole,
+			AmiType:       pulumi.String(amiType),
+			Version:       cluster.EksCluster.Version(),
+			InstanceTypes: pulumi.ToStringArray(group.InstanceTypes),
+			CapacityType:  pulumi.StringPtr(group.CapacityType),
+			Labels:        pulumi.ToStringMap(group.Labels),
+			SubnetIds:     subnetIDs,
+			ScalingConfig: &awseks.NodeGroupScalingConfigArgs{
+				DesiredSize: pulumi.Int(group.DesiredSize),
+				MinSize:     pulumi.Int(group.MinSize),
+				MaxSize:     pulumi.Int(group.MaxSize),
+			},
+			LaunchTemplate: &awseks.NodeGroupLaunchTemplateArgs{
+				Id:      launchTemplate.ID(),
+				Version: pulumi.Sprintf("%d", launchTemplate.LatestVersion),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		nodeGroups = append(nodeGroups, nodeGroup)
+	}
+	return nodeGroups, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sqs"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const nthServiceAccount = "aws-node-termination-handler"
+
+// nthEvents are the EventBridge events the Node Termination Handler drains nodes on.
+var nthEvents = map[string]map[string]interface{}{
+	"spot-interruption": {
+		"source":      []string{"aws.ec2"},
+		"detail-type": []string{"EC2 Spot Instance Interruption Warning"},
+	},
+	"rebalance-recommendation": {
+		"source":      []string{"aws.ec2"},
+		"detail-type": []string{"EC2 Instance Rebalance Recommendation"},
+	},
+	"instance-state-change": {
+		"source":      []string{"aws.ec2"},
+		"detail-type": []string{"EC2 Instance State-change Notification"},
+	},
+	"scheduled-change": {
+		"source":      []string{"aws.health"},
+		"detail-type": []string{"AWS Health Event"},
+		"detail": map[string]interface{}{
+			"service":           []string{"EC2"},
+			"eventTypeCategory": []string{"scheduledChange"},
+		},
+	},
+	"asg-lifecycle": {
+		"source":      []string{"aws.autoscaling"},
+		"detail-type": []string{"EC2 Instance-terminate Lifecycle Action"},
+	},
+}
+
+// installNodeTerminationHandler deploys the AWS Node Termination Handler in
+// queue mode, with the SQS queue and the EventBridge rules feeding it.
+func installNodeTerminationHandler(ctx *pulumi.Context, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	queue, err := sqs.NewQueue(ctx, "pulumi-backstage-flux-gitops-aws-nth-queue", &sqs.QueueArgs{
+		MessageRetentionSeconds: pulumi.Int(300),
+		SqsManagedSseEnabled:    pulumi.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	queuePolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("sqs:SendMessage"),
+				},
+				Principals: iam.GetPolicyDocumentStatementPrincipalArray{
+					iam.GetPolicyDocumentStatementPrincipalArgs{
+						Type: pulumi.String("Service"),
+						Identifiers: pulumi.StringArray{
+							pulumi.String("events.amazonaws.com"),
+							pulumi.String("sqs.amazonaws.com"),
+						},
+					},
+				},
+				Resources: pulumi.StringArray{
+					queue.Arn,
+				},
+			},
+		},
+	})
+	_, err = sqs.NewQueuePolicy(ctx, "pulumi-backstage-flux-gitops-aws-nth-queue-policy", &sqs.QueuePolicyArgs{
+		QueueUrl: queue.Url,
+		Policy:   queuePolicy.Json(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{"spot-interruption", "rebalance-recommendation", "instance-state-change", "scheduled-change", "asg-lifecycle"} {
+		pattern, err := json.Marshal(nthEvents[name])
+		if err != nil {
+			return err
+		}
+		rule, err := cloudwatch.NewEventRule(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-nth-%s-rule", name), &cloudwatch.EventRuleArgs{
+			EventPattern: pulumi.String(string(pattern)),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = cloudwatch.NewEventTarget(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-nth-%s-target", name), &cloudwatch.EventTargetArgs{
+			Rule: rule.Name,
+			Arn:  queue.Arn,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	role, err := newIRSARole(ctx, "nth-role", cluster, "kube-system", nthServiceAccount)
+	if err != nil {
+		return err
+	}
+
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("autoscaling:CompleteLifecycleAction"),
+					pulumi.String("autoscaling:DescribeAutoScalingInstances"),
+					pulumi.String("autoscaling:DescribeTags"),
+					pulumi.String("ec2:DescribeInstances"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.String("*"),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("sqs:DeleteMessage"),
+					pulumi.String("sqs:ReceiveMessage"),
+				},
+				Resources: pulumi.StringArray{
+					queue.Arn,
+				},
+			},
+		},
+	})
+	_, err = iam.NewRolePolicy(ctx, "nth-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return err
+	}
+
+	nth, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-node-termination-handler", &helm.ReleaseArgs{
+		Chart:     pulumi.String("oci://public.ecr.aws/aws-ec2/helm/aws-node-termination-handler"),
+		Namespace: pulumi.String("kube-system"),
+		Version:   pulumi.String("0.21.0"),
+		Values: pulumi.Map{
+			"enableSqsTerminationDraining": pulumi.Bool(true),
+			"queueURL":                     queue.Url,
+			"awsRegion":                    pulumi.String(region),
+			// the managed node group ASGs don't carry the NTH tag
+			"checkTagBeforeDraining": pulumi.Bool(false),
+			"replicas":               pulumi.Int(platformReplicas),
+			"priorityClassName":      pulumi.String(platformPriorityClass),
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(nthServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return err
+	}
+	return newDisruptionBudgets(ctx, nth.Namespace.Elem(), "app.kubernetes.io/name", []string{"aws-node-termination-handler"}, platformReplicas, provider, pulumi.DependsOn([]pulumi.Resource{nth}))
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/athena"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cur"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/glue"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	v1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/core/v1"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	openCostNamespace      = "opencost"
+	openCostServiceAccount = "opencost"
+	curPrefix              = "cur"
+	// openCostAllocationPath aggregates the allocated costs by namespace and
+	// Backstage component, Prometheus sanitizes the label to backstage_io_kubernetes_id.
+	openCostAllocationPath = "/allocation/compute?window=7d&aggregate=namespace,label:backstage_io_kubernetes_id"
+)
+
+// openCostConfig is read from the `openCost` config key.
+type openCostConfig struct {
+	Enabled bool `json:"enabled"`
+	// RetentionDays expires the cost and usage reports in the bucket.
+	RetentionDays int `json:"retentionDays"`
+}
+
+func (c openCostConfig) withDefaults() openCostConfig {
+	if c.RetentionDays == 0 {
+		c.RetentionDays = 400
+	}
+	return c
+}
+
+// costAndUsageReport is the CUR delivered to S3 and the Athena resources to query it.
+type costAndUsageReport struct {
+	bucket        *s3.BucketV2
+	resultsBucket *s3.BucketV2
+	database      *glue.CatalogDatabase
+	table         string
+	workgroup     *athena.Workgroup
+}
+
+// newCostAndUsageReport creates an hourly Parquet CUR with resource IDs, a Glue
+// crawler that keeps its Athena table up to date and a workgroup for the queries.
+func newCostAndUsageReport(ctx *pulumi.Context, cfg openCostConfig, accountID string) (*costAndUsageReport, error) {
+	// CUR is delivered by billingreports, which can't encrypt with the AWS managed KMS key
+	bucket, err := newPrivateBucket(ctx, "pulumi-backstage-flux-gitops-aws-cur", cfg.RetentionDays, "AES256")
+	if err != nil {
+		return nil, err
+	}
+
+	reportArn := "arn:aws:cur:us-east-1:" + accountID + ":definition/*"
+	bucketPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:GetBucketAcl"),
+					pulumi.String("s3:GetBucketPolicy"),
+				},
+				Resources: pulumi.StringArray{
+					bucket.Arn,
+				},
+				Principals: billingReportsPrincipal(),
+				Conditions: billingReportsConditions(accountID, reportArn),
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:PutObject"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.Sprintf("%s/*", bucket.Arn),
+				},
+				Principals: billingReportsPrincipal(),
+				Conditions: billingReportsConditions(accountID, reportArn),
+			},
+		},
+	})
+	policy, err := s3.NewBucketPolicy(ctx, "pulumi-backstage-flux-gitops-aws-cur-policy", &s3.BucketPolicyArgs{
+		Bucket: bucket.ID(),
+		Policy: bucketPolicy.Json(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the CUR API is only available in us-east-1
+	usEast1, err := aws.NewProvider(ctx, "pulumi-backstage-flux-gitops-aws-us-east-1", &aws.ProviderArgs{
+		Region: pulumi.String("us-east-1"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the Athena table is named after the report, underscores keep it a valid identifier
+	reportName := strings.ReplaceAll(clusterName, "-", "_")
+	_, err = cur.NewReportDefinition(ctx, "pulumi-backstage-flux-gitops-aws-cur", &cur.ReportDefinitionArgs{
+		ReportName:  pulumi.String(reportName),
+		TimeUnit:    pulumi.String("HOURLY"),
+		Format:      pulumi.String("Parquet"),
+		Compression: pulumi.String("Parquet"),
+		AdditionalSchemaElements: pulumi.StringArray{
+			pulumi.String("RESOURCES"),
+			pulumi.String("SPLIT_COST_ALLOCATION_DATA"),
+		},
+		AdditionalArtifacts: pulumi.StringArray{
+			pulumi.String("ATHENA"),
+		},
+		ReportVersioning: pulumi.String("OVERWRITE_REPORT"),
+		S3Bucket:         bucket.Bucket,
+		S3Prefix:         pulumi.String(curPrefix),
+		S3Region:         pulumi.String(region),
+	}, pulumi.Provider(usEast1), pulumi.DependsOn([]pulumi.Resource{policy}))
+	if err != nil {
+		return nil, err
+	}
+
+	database, err := glue.NewCatalogDatabase(ctx, "pulumi-backstage-flux-gitops-aws-cur-database", &glue.CatalogDatabaseArgs{
+		Name: pulumi.String(reportName + "_cur"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	crawlerRole, err := iam.NewRole(ctx, "pulumi-backstage-flux-gitops-aws-cur-crawler-role", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+			"Version": "2012-10-17",
+			"Statement": [{
+				"Effect": "Allow",
+				"Principal": {
+					"Service": "glue.amazonaws.com"
+				},
+				"Action": "sts:AssumeRole"
+			}]
+		}`),
+		ManagedPolicyArns: pulumi.StringArray{
+			pulumi.String("arn:aws:iam::aws:policy/service-role/AWSGlueServiceRole"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	crawlerPolicy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:GetObject"),
+					pulumi.String("s3:ListBucket"),
+				},
+				Resources: pulumi.StringArray{
+					bucket.Arn,
+					pulumi.Sprintf("%s/*", bucket.Arn),
+				},
+			},
+		},
+	})
+	_, err = iam.NewRolePolicy(ctx, "pulumi-backstage-flux-gitops-aws-cur-crawler-role-policy", &iam.RolePolicyArgs{
+		Role:   crawlerRole.Name,
+		Policy: crawlerPolicy.Json(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = glue.NewCrawler(ctx, "pulumi-backstage-flux-gitops-aws-cur-crawler", &glue.CrawlerArgs{
+		DatabaseName: database.Name,
+		Role:         crawlerRole.Arn,
+		Schedule:     pulumi.String("cron(0 6 * * ? *)"),
+		S3Targets: glue.CrawlerS3TargetArray{
+			&glue.CrawlerS3TargetArgs{
+				Path: pulumi.Sprintf("s3://%s/%s/%s/%s/", bucket.Bucket, curPrefix, reportName, reportName),
+				Exclusions: pulumi.StringArray{
+					pulumi.String("**.json"),
+					pulumi.String("**.yml"),
+					pulumi.String("**.sql"),
+					pulumi.String("**.csv"),
+					pulumi.String("**.gz"),
+					pulumi.String("**.zip"),
+				},
+			},
+		},
+		SchemaChangePolicy: &glue.CrawlerSchemaChangePolicyArgs{
+			UpdateBehavior: pulumi.String("UPDATE_IN_DATABASE"),
+			DeleteBehavior: pulumi.String("DELETE_FROM_DATABASE"),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resultsBucket, err := newPrivateBucket(ctx, "pulumi-backstage-flux-gitops-aws-athena-results", 7, "aws:kms")
+	if err != nil {
+		return nil, err
+	}
+
+	workgroup, err := athena.NewWorkgroup(ctx, "pulumi-backstage-flux-gitops-aws-opencost", &athena.WorkgroupArgs{
+		Configuration: &athena.WorkgroupConfigurationArgs{
+			EnforceWorkgroupConfiguration: pulumi.Bool(true),
+			ResultConfiguration: &athena.WorkgroupConfigurationResultConfigurationArgs{
+				OutputLocation: pulumi.Sprintf("s3://%s/", resultsBucket.Bucket),
+			},
+		},
+		ForceDestroy: pulumi.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &costAndUsageReport{
+		bucket:        bucket,
+		resultsBucket: resultsBucket,
+		database:      database,
+		table:         reportName,
+		workgroup:     workgroup,
+	}, nil
+}
+
+// billingReportsPrincipal is the service delivering the CUR.
+func billingReportsPrincipal() iam.GetPolicyDocumentStatementPrincipalArray {
+	return iam.GetPolicyDocumentStatementPrincipalArray{
+		iam.GetPolicyDocumentStatementPrincipalArgs{
+			Type: pulumi.String("Service"),
+			Identifiers: pulumi.StringArray{
+				pulumi.String("billingreports.amazonaws.com"),
+			},
+		},
+	}
+}
+
+// billingReportsConditions limits the delivery to the reports of this account.
+func billingReportsConditions(accountID, reportArn string) iam.GetPolicyDocumentStatementConditionArray {
+	return iam.GetPolicyDocumentStatementConditionArray{
+		iam.GetPolicyDocumentStatementConditionArgs{
+			Test:     pulumi.String("StringEquals"),
+			Variable: pulumi.String("aws:SourceAccount"),
+			Values:   pulumi.StringArray{pulumi.String(accountID)},
+		},
+		iam.GetPolicyDocumentStatementConditionArgs{
+			Test:     pulumi.String("ArnLike"),
+			Variable: pulumi.String("aws:SourceArn"),
+			Values:   pulumi.StringArray{pulumi.String(reportArn)},
+		},
+	}
+}
+
+// installOpenCost deploys OpenCost with AWS pricing and the CUR reconciliation
+// through Athena, reading the cluster metrics from kube-prometheus-stack. It
+// returns the allocation API path that aggregates by namespace and Backstage component.
+func installOpenCost(ctx *pulumi.Context, cfg openCostConfig, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (string, error) {
+	identity, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	report, err := newCostAndUsageReport(ctx, cfg, identity.AccountId)
+	if err != nil {
+		return "", err
+	}
+
+	role, err := newIRSARole(ctx, "opencost-role", cluster, openCostNamespace, openCostServiceAccount)
+	if err != nil {
+		return "", err
+	}
+
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("athena:GetQueryExecution"),
+					pulumi.String("athena:GetQueryResults"),
+					pulumi.String("athena:GetWorkGroup"),
+					pulumi.String("athena:StartQueryExecution"),
+					pulumi.String("athena:StopQueryExecution"),
+				},
+				Resources: pulumi.StringArray{
+					report.workgroup.Arn,
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("glue:GetDatabase"),
+					pulumi.String("glue:GetDatabases"),
+					pulumi.String("glue:GetPartition"),
+					pulumi.String("glue:GetPartitions"),
+					pulumi.String("glue:GetTable"),
+					pulumi.String("glue:GetTables"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.Sprintf("arn:aws:glue:%s:%s:catalog", region, identity.AccountId),
+					report.database.Arn,
+					pulumi.Sprintf("arn:aws:glue:%s:%s:table/%s/*", region, identity.AccountId, report.database.Name),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:GetBucketLocation"),
+					pulumi.String("s3:GetObject"),
+					pulumi.String("s3:ListBucket"),
+				},
+				Resources: pulumi.StringArray{
+					report.bucket.Arn,
+					pulumi.Sprintf("%s/*", report.bucket.Arn),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:AbortMultipartUpload"),
+					pulumi.String("s3:GetBucketLocation"),
+					pulumi.String("s3:GetObject"),
+					pulumi.String("s3:ListBucket"),
+					pulumi.String("s3:ListBucketMultipartUploads"),
+					pulumi.String("s3:PutObject"),
+				},
+				Resources: pulumi.StringArray{
+					report.resultsBucket.Arn,
+					pulumi.Sprintf("%s/*", report.resultsBucket.Arn),
+				},
+			},
+		},
+	})
+	_, err = iam.NewRolePolicy(ctx, "opencost-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	ns, err := v1.NewNamespace(ctx, "pulumi-backstage-flux-gitops-aws-opencost-ns", &v1.NamespaceArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name: pulumi.String(openCostNamespace),
+		},
+	}, pulumi.Provider(provider))
+	if err != nil {
+		return "", err
+	}
+
+	cloudIntegration := pulumi.All(report.resultsBucket.Bucket, report.database.Name, report.workgroup.Name).ApplyT(func(args []interface{}) (string, error) {
+		integration, err := json.Marshal(map[string]interface{}{
+			"aws": map[string]interface{}{
+				"athena": []map[string]interface{}{
+					{
+						"bucket":    "s3://" + args[0].(string),
+						"region":    region,
+						"database":  args[1].(string),
+						"table":     report.table,
+						"workgroup": args[2].(string),
+						"account":   identity.AccountId,
+						"authorizer": map[string]string{
+							"authorizerType": "AWSServiceAccount",
+						},
+					},
+				},
+			},
+		})
+		return string(integration), err
+	}).(pulumi.StringOutput)
+
+	integrationSecret, err := v1.NewSecret(ctx, "pulumi-backstage-flux-gitops-aws-opencost-cloud-integration", &v1.SecretArgs{
+		Metadata: &metav1.ObjectMetaArgs{
+			Name:      pulumi.String("cloud-integration"),
+			Namespace: ns.Metadata.Name(),
+		},
+		StringData: pulumi.StringMap{
+			"cloud-integration.json": cloudIntegration,
+		},
+	}, pulumi.Provider(provider))
+	if err != nil {
+		return "", err
+	}
+
+	// OpenCost keeps its state in memory, so it runs a single replica
+	openCost, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-opencost", &helm.ReleaseArgs{
+		Chart:     pulumi.String("opencost"),
+		Namespace: ns.Metadata.Name().Elem(),
+		Version:   pulumi.String("1.29.0"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://opencost.github.io/opencost-helm-chart"),
+		},
+		Values: pulumi.Map{
+			"priorityClassName": pulumi.String(platformPriorityClass),
+			"serviceAccount": pulumi.Map{
+				"name": pulumi.String(openCostServiceAccount),
+				"annotations": pulumi.StringMap{
+					"eks.amazonaws.com/role-arn": role.Arn,
+				},
+			},
+			"opencost": pulumi.Map{
+				"cloudIntegrationSecret": integrationSecret.Metadata.Name(),
+				"exporter": pulumi.Map{
+					"defaultClusterId": pulumi.String(clusterName),
+				},
+				"prometheus": pulumi.Map{
+					"internal": pulumi.Map{
+						"enabled":       pulumi.Bool(true),
+						"serviceName":   pulumi.String("prometheus-operated"),
+						"namespaceName": pulumi.String(monitoringNamespace),
+						"port":          pulumi.Int(9090),
+					},
+				},
+				"metrics": pulumi.Map{
+					"serviceMonitor": pulumi.Map{
+						"enabled": pulumi.Bool(true),
+					},
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return "", err
+	}
+
+	err = newDisruptionBudgets(ctx, openCost.Namespace.Elem(), "app.kubernetes.io/name", []string{"opencost"}, 1, provider)
+	if err != nil {
+		return "", err
+	}
+	return openCostAllocationPath, nil
+}
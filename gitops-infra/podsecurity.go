@@ -0,0 +1,453 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/apiextensions"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// eksRegistry hosts the images of the EKS add-ons in eu-central-1.
+const eksRegistry = "602401143452.dkr.ecr.eu-central-1.amazonaws.com/"
+
+// dockerHub is the registry of images referenced without a registry host.
+const dockerHub = "docker.io/"
+
+// podSecurityConfig is read from the `podSecurity` config key.
+type podSecurityConfig struct {
+	// Namespaces maps a namespace created by the program to its Pod Security levels.
+	Namespaces map[string]podSecurityLevels `json:"namespaces"`
+	// PolicyEngine installs kyverno or gatekeeper with the baseline policies, none when empty.
+	PolicyEngine string `json:"policyEngine"`
+	// Enforce rejects violating pods, otherwise the policies only audit.
+	Enforce bool `json:"enforce"`
+	// AllowedRegistries are image prefixes allowed next to our ECR and the EKS registry.
+	// Docker Hub orgs are listed as docker.io/<org>/ and also match the images
+	// referenced without the registry, official images need the docker.io/library/ form.
+	AllowedRegistries []string `json:"allowedRegistries"`
+}
+
+// podSecurityLevels are the privileged, baseline or restricted levels of the
+// pod-security.kubernetes.io labels.
+type podSecurityLevels struct {
+	Enforce string `json:"enforce"`
+	Audit   string `json:"audit"`
+	Warn    string `json:"warn"`
+}
+
+func (c podSecurityConfig) withDefaults() podSecurityConfig {
+	if c.Namespaces == nil {
+		c.Namespaces = map[string]podSecurityLevels{}
+	}
+	for _, namespace := range []string{fluxNamespace, operatorNamespace, albNamespace} {
+		if _, ok := c.Namespaces[namespace]; !ok {
+			c.Namespaces[namespace] = podSecurityLevels{
+				Enforce: "baseline",
+				Audit:   "restricted",
+				Warn:    "restricted",
+			}
+		}
+	}
+	if c.AllowedRegistries == nil {
+		c.AllowedRegistries = []string{
+			"ghcr.io/fluxcd/",
+			"ghcr.io/external-secrets/",
+			"ghcr.io/opencost/",
+			"public.ecr.aws/",
+			"registry.k8s.io/",
+			"quay.io/",
+			"docker.io/bitnami/",
+			"docker.io/calico/",
+			"docker.io/grafana/",
+			"docker.io/pulumi/",
+			"docker.io/velero/",
+		}
+	}
+	return c
+}
+
+// namespaceLabels returns the Pod Security Admission labels of the namespace.
+func (c podSecurityConfig) namespaceLabels(namespace string) pulumi.StringMap {
+	labels := pulumi.StringMap{}
+	levels := c.Namespaces[namespace]
+	for mode, level := range map[string]string{
+		"enforce": levels.Enforce,
+		"audit":   levels.Audit,
+		"warn":    levels.Warn,
+	} {
+		if level != "" {
+			labels["pod-security.kubernetes.io/"+mode] = pulumi.String(level)
+		}
+	}
+	return labels
+}
+
+// baselinePolicy is a single admission policy, rendered for the configured engine.
+type baselinePolicy struct {
+	name    string
+	kind    string
+	message string
+	// kyvernoPattern validates the pod spec in a Kyverno ClusterPolicy.
+	kyvernoPattern pulumi.Map
+	// rego implements the Gatekeeper ConstraintTemplate.
+	rego            string
+	parameters      pulumi.Map
+	parameterSchema pulumi.Map
+}
+
+// regoContainers collects all containers of the reviewed pod.
+const regoContainers = `
+input_containers[c] {
+  c := input.review.object.spec.containers[_]
+}
+input_containers[c] {
+  c := input.review.object.spec.initContainers[_]
+}
+input_containers[c] {
+  c := input.review.object.spec.ephemeralContainers[_]
+}
+`
+
+// imagePrefixes returns the prefixes the images of the registries start with.
+// The policies match the image as written in the pod spec, so Docker Hub orgs
+// are allowed with and without the registry host, e.g. velero/velero.
+func imagePrefixes(registries []string) []string {
+	var prefixes []string
+	for _, registry := range registries {
+		prefixes = append(prefixes, registry)
+		if org, ok := strings.CutPrefix(registry, dockerHub); ok && org != "" && !strings.HasPrefix(org, "library/") {
+			prefixes = append(prefixes, org)
+		}
+	}
+	return prefixes
+}
+
+// baselinePolicies returns the policies every pod has to satisfy: no
+// privileged containers, resource limits and images from allowed registries.
+func baselinePolicies(registries []string) []baselinePolicy {
+	prefixes := imagePrefixes(registries)
+	var imagePatterns []string
+	for _, prefix := range prefixes {
+		imagePatterns = append(imagePatterns, prefix+"*")
+	}
+	noPrivileged := pulumi.Array{
+		pulumi.Map{
+			"=(securityContext)": pulumi.Map{
+				"=(privileged)": pulumi.String("false"),
+			},
+		},
+	}
+	allowedImages := pulumi.Array{
+		pulumi.Map{
+			"image": pulumi.String(strings.Join(imagePatterns, " | ")),
+		},
+	}
+
+	return []baselinePolicy{
+		{
+			name:    "disallow-privileged-containers",
+			kind:    "K8sDisallowPrivileged",
+			message: "Privileged containers are not allowed.",
+			kyvernoPattern: pulumi.Map{
+				"spec": pulumi.Map{
+					"=(ephemeralContainers)": noPrivileged,
+					"=(initContainers)":      noPrivileged,
+					"containers":             noPrivileged,
+				},
+			},
+			rego: `package k8sdisallowprivileged
+
+violation[{"msg": msg}] {
+  c := input_containers[_]
+  c.securityContext.privileged
+  msg := sprintf("privileged container %v is not allowed", [c.name])
+}
+` + regoContainers,
+		},
+		{
+			name:    "require-resource-limits",
+			kind:    "K8sRequireResourceLimits",
+			message: "CPU and memory limits are required.",
+			kyvernoPattern: pulumi.Map{
+				"spec": pulumi.Map{
+					"containers": pulumi.Array{
+						pulumi.Map{
+							"resources": pulumi.Map{
+								"limits": pulumi.Map{
+									"cpu":    pulumi.String("?*"),
+									"memory": pulumi.String("?*"),
+								},
+							},
+						},
+					},
+				},
+			},
+			rego: `package k8srequireresourcelimits
+
+violation[{"msg": msg}] {
+  c := input.review.object.spec.containers[_]
+  not c.resources.limits.cpu
+  msg := sprintf("container %v has no cpu limit", [c.name])
+}
+
+violation[{"msg": msg}] {
+  c := input.review.object.spec.containers[_]
+  not c.resources.limits.memory
+  msg := sprintf("container %v has no memory limit", [c.name])
+}
+`,
+		},
+		{
+			name:    "restrict-image-registries",
+			kind:    "K8sAllowedRegistries",
+			message: "Images must come from an allowed registry.",
+			kyvernoPattern: pulumi.Map{
+				"spec": pulumi.Map{
+					"=(ephemeralContainers)": allowedImages,
+					"=(initContainers)":      allowedImages,
+					"containers":             allowedImages,
+				},
+			},
+			rego: `package k8sallowedregistries
+
+violation[{"msg": msg}] {
+  c := input_containers[_]
+  not startswith_any(c.image, input.parameters.registries)
+  msg := sprintf("container %v uses image %v from a registry that is not allowed", [c.name, c.image])
+}
+
+startswith_any(image, registries) {
+  startswith(image, registries[_])
+}
+` + regoContainers,
+			parameters: pulumi.Map{
+				"registries": pulumi.ToStringArray(prefixes),
+			},
+			parameterSchema: pulumi.Map{
+				"registries": pulumi.Map{
+					"type": pulumi.String("array"),
+					"items": pulumi.Map{
+						"type": pulumi.String("string"),
+					},
+				},
+			},
+		},
+	}
+}
+
+// installPolicyEngine deploys Kyverno or Gatekeeper and the baseline policies.
+// Our ECR and the EKS registry are always allowed image sources.
+func installPolicyEngine(ctx *pulumi.Context, cfg podSecurityConfig, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	identity, err := aws.GetCallerIdentity(ctx, nil)
+	if err != nil {
+		return err
+	}
+	registries := append([]string{
+		fmt.Sprintf("%s.dkr.ecr.%s.amazonaws.com/", identity.AccountId, region),
+		eksRegistry,
+	}, cfg.AllowedRegistries...)
+	policies := baselinePolicies(registries)
+
+	switch cfg.PolicyEngine {
+	case "kyverno":
+		return installKyverno(ctx, policies, cfg.Enforce, provider, opts...)
+	case "gatekeeper":
+		return installGatekeeper(ctx, policies, cfg.Enforce, provider, opts...)
+	}
+	return fmt.Errorf("unsupported policy engine %q, use kyverno or gatekeeper", cfg.PolicyEngine)
+}
+
+func installKyverno(ctx *pulumi.Context, policies []baselinePolicy, enforce bool, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	kyverno, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-kyverno", &helm.ReleaseArgs{
+		Chart:           pulumi.String("kyverno"),
+		Namespace:       pulumi.String("kyverno"),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("3.1.4"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://kyverno.github.io/kyverno/"),
+		},
+		Values: pulumi.Map{
+			// the admission webhook fails closed, so it keeps a replica through drains
+			"admissionController": pulumi.Map{
+				"replicas":          pulumi.Int(platformReplicas),
+				"priorityClassName": pulumi.String(platformPriorityClass),
+				"podDisruptionBudget": pulumi.Map{
+					"enabled":      pulumi.Bool(true),
+					"minAvailable": pulumi.Int(1),
+				},
+			},
+			"backgroundController": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"cleanupController": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+			"reportsController": pulumi.Map{
+				"priorityClassName": pulumi.String(platformPriorityClass),
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return err
+	}
+
+	action := "Audit"
+	if enforce {
+		action = "Enforce"
+	}
+	for _, policy := range policies {
+		_, err = apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-policy", policy.name), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("kyverno.io/v1"),
+			Kind:       pulumi.String("ClusterPolicy"),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name: pulumi.String(policy.name),
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": pulumi.Map{
+					"validationFailureAction": pulumi.String(action),
+					"background":              pulumi.Bool(true),
+					"rules": pulumi.Array{
+						pulumi.Map{
+							"name": pulumi.String(policy.name),
+							"match": pulumi.Map{
+								"any": pulumi.Array{
+									pulumi.Map{
+										"resources": pulumi.Map{
+											"kinds": pulumi.StringArray{
+												pulumi.String("Pod"),
+											},
+										},
+									},
+								},
+							},
+							"exclude": pulumi.Map{
+								"any": pulumi.Array{
+									pulumi.Map{
+										"resources": pulumi.Map{
+											"namespaces": pulumi.StringArray{
+												pulumi.String("kube-system"),
+												pulumi.String("kyverno"),
+											},
+										},
+									},
+								},
+							},
+							"validate": pulumi.Map{
+								"message": pulumi.String(policy.message),
+								"pattern": policy.kyvernoPattern,
+							},
+						},
+					},
+				},
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{kyverno}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func installGatekeeper(ctx *pulumi.Context, policies []baselinePolicy, enforce bool, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) error {
+	// the chart runs three webhook replicas with a disruption budget and the
+	// system-cluster-critical priority by default
+	gatekeeper, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-gatekeeper", &helm.ReleaseArgs{
+		Chart:           pulumi.String("gatekeeper"),
+		Namespace:       pulumi.String("gatekeeper-system"),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("3.15.1"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://open-policy-agent.github.io/gatekeeper/charts"),
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return err
+	}
+
+	action := "dryrun"
+	if enforce {
+		action = "deny"
+	}
+	for _, policy := range policies {
+		crdSpec := pulumi.Map{
+			"names": pulumi.Map{
+				"kind": pulumi.String(policy.kind),
+			},
+		}
+		if policy.parameterSchema != nil {
+			crdSpec["validation"] = pulumi.Map{
+				"openAPIV3Schema": pulumi.Map{
+					"type":       pulumi.String("object"),
+					"properties": policy.parameterSchema,
+				},
+			}
+		}
+		template := pulumi.Map{
+			"crd": pulumi.Map{
+				"spec": crdSpec,
+			},
+			"targets": pulumi.Array{
+				pulumi.Map{
+					"target": pulumi.String("admission.k8s.gatekeeper.sh"),
+					"rego":   pulumi.String(policy.rego),
+				},
+			},
+		}
+
+		constraintTemplate, err := apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-template", policy.name), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("templates.gatekeeper.sh/v1"),
+			Kind:       pulumi.String("ConstraintTemplate"),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name: pulumi.String(strings.ToLower(policy.kind)),
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": template,
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{gatekeeper}))
+		if err != nil {
+			return err
+		}
+
+		constraint := pulumi.Map{
+			"enforcementAction": pulumi.String(action),
+			"match": pulumi.Map{
+				"kinds": pulumi.Array{
+					pulumi.Map{
+						"apiGroups": pulumi.StringArray{
+							pulumi.String(""),
+						},
+						"kinds": pulumi.StringArray{
+							pulumi.String("Pod"),
+						},
+					},
+				},
+				"excludedNamespaces": pulumi.StringArray{
+					pulumi.String("kube-system"),
+					pulumi.String("gatekeeper-system"),
+				},
+			},
+		}
+		if policy.parameters != nil {
+			constraint["parameters"] = policy.parameters
+		}
+		_, err = apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-%s-constraint", policy.name), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("constraints.gatekeeper.sh/v1beta1"),
+			Kind:       pulumi.String(policy.kind),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name: pulumi.String(policy.name),
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": constraint,
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{constraintTemplate}))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
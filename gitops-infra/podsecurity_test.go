@@ -0,0 +1,132 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// deployedImages are the images of the charts the program installs, as they
+// are written in the rendered pod specs, outside of the excluded namespaces.
+var deployedImages = []string{
+	// flux2
+	"ghcr.io/fluxcd/source-controller:v1.2.4",
+	"ghcr.io/fluxcd/kustomize-controller:v1.2.2",
+	"ghcr.io/fluxcd/helm-controller:v0.37.4",
+	"ghcr.io/fluxcd/notification-controller:v1.2.4",
+	"ghcr.io/fluxcd/image-reflector-controller:v0.31.2",
+	"ghcr.io/fluxcd/image-automation-controller:v0.37.1",
+	// cert-manager and aws-privateca-issuer
+	"quay.io/jetstack/cert-manager-controller:v1.14.4",
+	"quay.io/jetstack/cert-manager-cainjector:v1.14.4",
+	"quay.io/jetstack/cert-manager-webhook:v1.14.4",
+	"quay.io/jetstack/cert-manager-startupapicheck:v1.14.4",
+	"public.ecr.aws/k1n1h4h4/cert-manager-aws-privateca-issuer:v1.2.7",
+	// external-dns and external-secrets
+	"registry.k8s.io/external-dns/external-dns:v0.14.0",
+	"ghcr.io/external-secrets/external-secrets:v0.9.13",
+	// kube-prometheus-stack
+	"quay.io/prometheus-operator/prometheus-operator:v0.71.2",
+	"quay.io/prometheus-operator/prometheus-config-reloader:v0.71.2",
+	"quay.io/prometheus/prometheus:v2.50.1",
+	"quay.io/prometheus/alertmanager:v0.27.0",
+	"quay.io/prometheus/node-exporter:v1.7.0",
+	"registry.k8s.io/kube-state-metrics/kube-state-metrics:v2.10.1",
+	"registry.k8s.io/ingress-nginx/kube-webhook-certgen:v20221220-controller-v1.5.1-58-g787ea74b6",
+	"docker.io/grafana/grafana:10.3.3",
+	"quay.io/kiwigrid/k8s-sidecar:1.26.1",
+	// tigera-operator and the Calico components it runs
+	"quay.io/tigera/operator:v1.32.5",
+	"docker.io/calico/node:v3.27.2",
+	"docker.io/calico/typha:v3.27.2",
+	"docker.io/calico/kube-controllers:v3.27.2",
+	"docker.io/calico/csi:v3.27.2",
+	// aws-node-termination-handler and opencost
+	"public.ecr.aws/aws-ec2/aws-node-termination-handler:v1.19.0",
+	"ghcr.io/opencost/opencost:1.108.0",
+	"ghcr.io/opencost/opencost-ui:1.108.0",
+	// velero
+	"velero/velero:v1.13.0",
+	"velero/velero-plugin-for-aws:v1.9.0",
+	"docker.io/bitnami/kubectl:1.29",
+	// deployed by Flux from the bootstrap repository
+	"public.ecr.aws/eks/aws-load-balancer-controller:v2.7.1",
+	"pulumi/pulumi-kubernetes-operator:v1.14.0",
+}
+
+// imagePolicy renders the registry policy for our ECR and the default registries.
+func imagePolicy(t *testing.T) (string, pulumi.StringArray) {
+	registries := append([]string{
+		"123456789012.dkr.ecr.eu-central-1.amazonaws.com/",
+		eksRegistry,
+	}, podSecurityConfig{}.withDefaults().AllowedRegistries...)
+	for _, policy := range baselinePolicies(registries) {
+		if policy.kind == "K8sAllowedRegistries" {
+			containers := policy.kyvernoPattern["spec"].(pulumi.Map)["containers"].(pulumi.Array)
+			pattern := containers[0].(pulumi.Map)["image"].(pulumi.String)
+			return string(pattern), policy.parameters["registries"].(pulumi.StringArray)
+		}
+	}
+	t.Fatal("no registry policy")
+	return "", nil
+}
+
+// kyvernoAllows matches the image against the alternatives of a Kyverno
+// pattern, where * matches any characters.
+func kyvernoAllows(pattern, image string) bool {
+	for _, alternative := range strings.Split(pattern, " | ") {
+		expr := strings.ReplaceAll(regexp.QuoteMeta(alternative), `\*`, ".*")
+		if regexp.MustCompile("^" + expr + "$").MatchString(image) {
+			return true
+		}
+	}
+	return false
+}
+
+// gatekeeperAllows mirrors the startswith check of the Rego policy.
+func gatekeeperAllows(registries pulumi.StringArray, image string) bool {
+	for _, registry := range registries {
+		if strings.HasPrefix(image, string(registry.(pulumi.String))) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegistryPolicyAllowsDeployedImages(t *testing.T) {
+	pattern, registries := imagePolicy(t)
+	images := append([]string{
+		"123456789012.dkr.ecr.eu-central-1.amazonaws.com/backstage:latest",
+		eksRegistry + "eks/coredns:v1.11.1-eksbuild.4",
+	}, deployedImages...)
+	for _, image := range images {
+		if !kyvernoAllows(pattern, image) {
+			t.Errorf("kyverno rejects %s", image)
+		}
+		if !gatekeeperAllows(registries, image) {
+			t.Errorf("gatekeeper rejects %s", image)
+		}
+	}
+}
+
+func TestRegistryPolicyRejectsOtherImages(t *testing.T) {
+	pattern, registries := imagePolicy(t)
+	for _, image := range []string{
+		"nginx:1.25",
+		"library/nginx:1.25",
+		"attacker/miner:latest",
+		"docker.io/attacker/miner:latest",
+		"ghcr.io/attacker/miner:latest",
+		"210987654321.dkr.ecr.eu-central-1.amazonaws.com/backstage:latest",
+		"velero.example.com/velero/velero:v1.13.0",
+	} {
+		if kyvernoAllows(pattern, image) {
+			t.Errorf("kyverno allows %s", image)
+		}
+		if gatekeeperAllows(registries, image) {
+			t.Errorf("gatekeeper allows %s", image)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// iamPolicies holds the IAM policy documents of the add-ons, laid out as
+// iam-policies/<add-on>/<version>.json so every policy matches exactly one
+// release of the controller that uses it.
+//
+//go:embed iam-policies
+var iamPolicies embed.FS
+
+// iamPolicy returns the embedded IAM policy document for the given add-on version.
+func iamPolicy(addon, version string) (string, error) {
+	policy, err := iamPolicies.ReadFile(path.Join("iam-policies", addon, version+".json"))
+	if err == nil {
+		return string(policy), nil
+	}
+	entries, err := iamPolicies.ReadDir(path.Join("iam-policies", addon))
+	if err != nil {
+		return "", fmt.Errorf("no IAM policies embedded for add-on %q", addon)
+	}
+	var versions []string
+	for _, entry := range entries {
+		versions = append(versions, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return "", fmt.Errorf("no IAM policy embedded for %s version %q, available versions: %s", addon, version, strings.Join(versions, ", "))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	awseks "github.com/pulumi/pulumi-aws/sdk/v6/go/aws/eks"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const fluxChartVersion = "2.12.2"
+
+// fluxKubernetesSupport maps the minor version of the flux2 chart to the
+// oldest and newest Kubernetes versions its Flux release supports.
+var fluxKubernetesSupport = map[string][2]string{
+	"2.11": {"1.25", "1.28"},
+	"2.12": {"1.26", "1.29"},
+	"2.13": {"1.28", "1.30"},
+}
+
+// currentEKSVersion returns the Kubernetes version the cluster runs today, or
+// an empty string when the cluster doesn't exist yet.
+func currentEKSVersion(ctx *pulumi.Context) (string, error) {
+	clusters, err := awseks.GetClusters(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range clusters.Names {
+		if name != clusterName {
+			continue
+		}
+		existing, err := awseks.LookupCluster(ctx, &awseks.LookupClusterArgs{
+			Name: clusterName,
+		})
+		if err != nil {
+			return "", err
+		}
+		return existing.Version, nil
+	}
+	return "", nil
+}
+
+// checkFluxSupport fails when the Flux chart doesn't support the Kubernetes version.
+func checkFluxSupport(eksVersion string) error {
+	parts := versionParts(fluxChartVersion)
+	chartMinor := fmt.Sprintf("%d.%d", parts[0], parts[1])
+	supported, ok := fluxKubernetesSupport[chartMinor]
+	if !ok {
+		return fmt.Errorf("unknown Kubernetes support of flux2 chart %s", fluxChartVersion)
+	}
+	if compareVersions(eksVersion, supported[0]) < 0 || compareVersions(eksVersion, supported[1]) > 0 {
+		return fmt.Errorf("flux2 chart %s supports Kubernetes %s to %s, not %s", fluxChartVersion, supported[0], supported[1], eksVersion)
+	}
+	return nil
+}
+
+// checkEKSUpgrade guards changes of `eksVersion`. A version change is only
+// accepted with `eksUpgrade` enabled, must move exactly one minor version
+// forward, and all pinned add-ons and the Flux chart must support the target.
+// During preview the upgrade plan is logged.
+func checkEKSUpgrade(ctx *pulumi.Context, target string, upgrade bool, addons map[string]addonConfig) error {
+	current, err := currentEKSVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current == "" || compareVersions(current, target) == 0 {
+		return nil
+	}
+
+	from, to := versionParts(current), versionParts(target)
+	if len(from) < 2 || len(to) < 2 {
+		return fmt.Errorf("cannot compare EKS versions %q and %q", current, target)
+	}
+	switch {
+	case compareVersions(target, current) < 0:
+		return fmt.Errorf("refusing to downgrade EKS from %s to %s", current, target)
+	case to[0] != from[0] || to[1] != from[1]+1:
+		return fmt.Errorf("refusing to upgrade EKS from %s to %s, upgrade one minor version at a time", current, target)
+	case !upgrade:
+		return fmt.Errorf("eksVersion changed from %s to %s, set eksUpgrade to true to upgrade the cluster", current, target)
+	}
+
+	if err := checkFluxSupport(target); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(addons))
+	for name := range addons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var incompatible []string
+	for _, name := range names {
+		compatible, err := checkAddonVersion(ctx, name, addons[name], target)
+		if err != nil {
+			return err
+		}
+		if !compatible {
+			incompatible = append(incompatible, name)
+		}
+	}
+	if len(incompatible) > 0 {
+		return fmt.Errorf("add-ons %s do not support Kubernetes %s, update their pinned versions first", strings.Join(incompatible, ", "), target)
+	}
+
+	if ctx.DryRun() {
+		plan := []string{
+			fmt.Sprintf("EKS upgrade plan %s -> %s:", current, target),
+			fmt.Sprintf("  1. upgrade the control plane to %s", target),
+			fmt.Sprintf("  2. update the managed add-ons %s", strings.Join(names, ", ")),
+			"  3. roll the node groups onto the new control-plane version",
+		}
+		return ctx.Log.Info(strings.Join(plan, "\n"), nil)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
+	"github.com/pulumi/pulumi-eks/sdk/v2/go/eks"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/apiextensions"
+	"github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/helm/v3"
+	metav1 "github.com/pulumi/pulumi-kubernetes/sdk/v4/go/kubernetes/meta/v1"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+const (
+	veleroNamespace      = "velero"
+	veleroServiceAccount = "velero-server"
+)
+
+// veleroConfig is read from the `velero` config key.
+type veleroConfig struct {
+	Enabled bool `json:"enabled"`
+	// RetentionDays expires backups in the bucket, it should exceed the longest schedule TTL.
+	RetentionDays int                       `json:"retentionDays"`
+	Schedules     map[string]veleroSchedule `json:"schedules"`
+}
+
+// veleroSchedule is a Velero backup schedule.
+type veleroSchedule struct {
+	// Schedule is a cron expression.
+	Schedule           string   `json:"schedule"`
+	IncludedNamespaces []string `json:"includedNamespaces"`
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+	// TTL is the lifetime of a backup, as a duration like 720h.
+	TTL string `json:"ttl"`
+}
+
+func (c veleroConfig) withDefaults() veleroConfig {
+	if c.RetentionDays == 0 {
+		c.RetentionDays = 90
+	}
+	if c.Schedules == nil {
+		c.Schedules = map[string]veleroSchedule{
+			"daily": {
+				Schedule: "0 3 * * *",
+			},
+		}
+	}
+	for name, schedule := range c.Schedules {
+		if len(schedule.IncludedNamespaces) == 0 {
+			schedule.IncludedNamespaces = []string{"*"}
+		}
+		if schedule.TTL == "" {
+			schedule.TTL = "720h"
+		}
+		c.Schedules[name] = schedule
+	}
+	return c
+}
+
+// installVelero creates the backup bucket and deploys Velero with an IRSA role
+// that may write to the bucket and snapshot EBS volumes, and the configured
+// backup schedules. It returns the bucket name.
+func installVelero(ctx *pulumi.Context, cfg veleroConfig, cluster *eks.Cluster, provider pulumi.ProviderResource, opts ...pulumi.ResourceOption) (pulumi.StringOutput, error) {
+	bucket, err := newPrivateBucket(ctx, "pulumi-backstage-flux-gitops-aws-velero", cfg.RetentionDays, "aws:kms")
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	role, err := newIRSARole(ctx, "velero-role", cluster, veleroNamespace, veleroServiceAccount)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	policy := iam.GetPolicyDocumentOutput(ctx, iam.GetPolicyDocumentOutputArgs{
+		Statements: iam.GetPolicyDocumentStatementArray{
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("ec2:DescribeVolumes"),
+					pulumi.String("ec2:DescribeSnapshots"),
+					pulumi.String("ec2:CreateTags"),
+					pulumi.String("ec2:CreateVolume"),
+					pulumi.String("ec2:CreateSnapshot"),
+					pulumi.String("ec2:DeleteSnapshot"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.String("*"),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:GetObject"),
+					pulumi.String("s3:DeleteObject"),
+					pulumi.String("s3:PutObject"),
+					pulumi.String("s3:AbortMultipartUpload"),
+					pulumi.String("s3:ListMultipartUploadParts"),
+				},
+				Resources: pulumi.StringArray{
+					pulumi.Sprintf("%s/*", bucket.Arn),
+				},
+			},
+			iam.GetPolicyDocumentStatementArgs{
+				Effect: pulumi.String("Allow"),
+				Actions: pulumi.StringArray{
+					pulumi.String("s3:ListBucket"),
+				},
+				Resources: pulumi.StringArray{
+					bucket.Arn,
+				},
+			},
+		},
+	})
+
+	_, err = iam.NewRolePolicy(ctx, "velero-role-policy", &iam.RolePolicyArgs{
+		Role:   role.Name,
+		Policy: policy.Json(),
+	})
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	// the Velero server runs a single replica
+	velero, err := helm.NewRelease(ctx, "pulumi-backstage-flux-gitops-aws-velero", &helm.ReleaseArgs{
+		Chart:           pulumi.String("velero"),
+		Namespace:       pulumi.String(veleroNamespace),
+		CreateNamespace: pulumi.Bool(true),
+		Version:         pulumi.String("6.0.0"),
+		RepositoryOpts: &helm.RepositoryOptsArgs{
+			Repo: pulumi.String("https://vmware-tanzu.github.io/helm-charts"),
+		},
+		Values: pulumi.Map{
+			"initContainers": pulumi.Array{
+				pulumi.Map{
+					"name":  pulumi.String("velero-plugin-for-aws"),
+					"image": pulumi.String("velero/velero-plugin-for-aws:v1.9.0"),
+					"volumeMounts": pulumi.Array{
+						pulumi.Map{
+							"mountPath": pulumi.String("/target"),
+							"name":      pulumi.String("plugins"),
+						},
+					},
+				},
+			},
+			"configuration": pulumi.Map{
+				"backupStorageLocation": pulumi.Array{
+					pulumi.Map{
+						"name":     pulumi.String("default"),
+						"provider": pulumi.String("aws"),
+						"bucket":   bucket.Bucket,
+						"config": pulumi.Map{
+							"region": pulumi.String(region),
+						},
+					},
+				},
+				"volumeSnapshotLocation": pulumi.Array{
+					pulumi.Map{
+						"name":     pulumi.String("default"),
+						"provider": pulumi.String("aws"),
+						"config": pulumi.Map{
+							"region": pulumi.String(region),
+						},
+					},
+				},
+			},
+			"snapshotsEnabled":  pulumi.Bool(true),
+			"priorityClassName": pulumi.String(platformPriorityClass),
+			"credentials": pulumi.Map{
+				"useSecret": pulumi.Bool(false),
+			},
+			"serviceAccount": pulumi.Map{
+				"server": pulumi.Map{
+					"name": pulumi.String(veleroServiceAccount),
+					"annotations": pulumi.StringMap{
+						"eks.amazonaws.com/role-arn": role.Arn,
+					},
+				},
+			},
+		},
+	}, append(opts, pulumi.Provider(provider))...)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	err = newDisruptionBudgets(ctx, velero.Namespace.Elem(), "app.kubernetes.io/name", []string{"velero"}, 1, provider)
+	if err != nil {
+		return pulumi.StringOutput{}, err
+	}
+
+	names := make([]string, 0, len(cfg.Schedules))
+	for name := range cfg.Schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schedule := cfg.Schedules[name]
+		_, err = apiextensions.NewCustomResource(ctx, fmt.Sprintf("pulumi-backstage-flux-gitops-aws-velero-%s-schedule", name), &apiextensions.CustomResourceArgs{
+			ApiVersion: pulumi.String("velero.io/v1"),
+			Kind:       pulumi.String("Schedule"),
+			Metadata: &metav1.ObjectMetaArgs{
+				Name:      pulumi.String(name),
+				Namespace: velero.Namespace,
+			},
+			OtherFields: kubernetes.UntypedArgs{
+				"spec": pulumi.Map{
+					"schedule": pulumi.String(schedule.Schedule),
+					"template": pulumi.Map{
+						"ttl":                pulumi.String(schedule.TTL),
+						"includedNamespaces": pulumi.ToStringArray(schedule.IncludedNamespaces),
+						"excludedNamespaces": pulumi.ToStringArray(schedule.ExcludedNamespaces),
+						"snapshotVolumes":    pulumi.Bool(true),
+						"storageLocation":    pulumi.String("default"),
+					},
+				},
+			},
+		}, pulumi.Provider(provider), pulumi.DependsOn([]pulumi.Resource{velero}))
+		if err != nil {
+			return pulumi.StringOutput{}, err
+		}
+	}
+	return bucket.Bucket, nil
+}
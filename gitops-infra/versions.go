@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// versionParts splits versions like "1.28", "2.12.2" or "v1.16.0-eksbuild.1"
+// into their numeric components, ignoring everything that isn't a digit.
+func versionParts(version string) []int {
+	fields := strings.FieldsFunc(version, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	parts := make([]int, 0, len(fields))
+	for _, field := range fields {
+		n, _ := strconv.Atoi(field)
+		parts = append(parts, n)
+	}
+	return parts
+}
+
+// compareVersions returns -1, 0 or 1 when a is older than, equal to or newer than b.
+func compareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}